@@ -0,0 +1,373 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parnurzeal/gorequest"
+)
+
+// disconf-web 的管理接口, 用于发布配置. 使用 Fetcher 的 host 列表、重试、指标和日志,
+// 每个 host 第一次请求前用 user/password 登录, 会话保存在 cookie 中
+type Admin struct {
+	fetcher  *Fetcher
+	user     string
+	password string
+	dryRun   bool
+	// 打印操作和写入 zk 节点时掩码的 key, 同 WithSecretKeys
+	secretKeys []string
+	jar        http.CookieJar
+	mutex      sync.Mutex
+	// 已登录的 host
+	sessions map[string]bool
+}
+
+type AdminOption func(*Admin)
+
+// 一次写操作, dry run 时只返回不执行
+type AdminAction struct {
+	Method string
+	// http 路径或 zk 节点
+	Path   string
+	Form   map[string]string
+	DryRun bool
+	// 配置项或配置文件名
+	Key        string
+	secretKeys []string
+}
+
+type adminResp struct {
+	Success string      `json:"success"`
+	Message interface{} `json:"message"`
+	Page    struct {
+		Results []adminEntity `json:"result"`
+	} `json:"page"`
+}
+
+// app 或 env
+type adminEntity struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+const (
+	DISCONF_SIGNIN_ACTION       = "/api/account/signin"
+	DISCONF_APP_LIST_ACTION     = "/api/app/list"
+	DISCONF_ENV_LIST_ACTION     = "/api/env/list"
+	DISCONF_WEB_ITEM_ACTION     = "/api/web/config/item"
+	DISCONF_WEB_FILETEXT_ACTION = "/api/web/config/filetext"
+	DISCONF_WEB_CONFIG_ACTION   = "/api/web/config"
+	ZK_SET_METHOD               = "ZK_SET"
+	// 打印 AdminAction 时表单值的最大长度
+	ADMIN_FORM_VALUE_MAX = 64
+)
+
+// 只打印将要执行的操作, 不登录也不修改服务端和 zk
+func WithDryRun() AdminOption {
+	return func(a *Admin) {
+		a.dryRun = true
+	}
+}
+
+// 按 WithSecretKeys 的通配符规则标记敏感配置项, 打印操作时掩码其值, Notify 写入 zk 节点的值也会掩码
+func WithAdminSecretKeys(patterns ...string) AdminOption {
+	return func(a *Admin) {
+		a.secretKeys = append(a.secretKeys, patterns...)
+	}
+}
+
+func NewAdmin(fetcher *Fetcher, user, password string, opts ...AdminOption) (*Admin, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	a := &Admin{
+		fetcher:  fetcher,
+		user:     user,
+		password: password,
+		jar:      jar,
+		sessions: make(map[string]bool),
+	}
+	for _, o := range opts {
+		o(a)
+	}
+	return a, nil
+}
+
+// 登录第一个可用的 host, 用于检查用户名和密码
+func (a *Admin) Login(ctx context.Context) error {
+	var errs []error
+	for i := range a.fetcher.hostList {
+		err := a.login(ctx, i)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("login [errs:%v]", errs)
+}
+
+func (a *Admin) login(ctx context.Context, hostIndex int) error {
+	host := a.fetcher.hostList[hostIndex]
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.sessions[host] {
+		return nil
+	}
+	form := map[string]string{"name": a.user, "password": a.password, "remember": "0"}
+	if err := a.send(ctx, hostIndex, http.MethodPost, DISCONF_SIGNIN_ACTION, DISCONF_SIGNIN_ACTION, form, &adminResp{}); err != nil {
+		return fmt.Errorf("login [host:%v] [err:%v]", host, err)
+	}
+	a.sessions[host] = true
+	return nil
+}
+
+// 依次请求每个 host, 需要时先登录. 写操作只在连接失败 (请求没有发出) 时换下一个 host,
+// 其他错误时服务端可能已经执行, 直接返回, 避免重复写入
+func (a *Admin) do(ctx context.Context, method, action, path string, form map[string]string, resp *adminResp) error {
+	var errs []error
+	for i := range a.fetcher.hostList {
+		if err := a.login(ctx, i); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err := a.send(ctx, i, method, action, path, form, resp)
+		if err == nil {
+			return nil
+		}
+		// 会话可能已过期, 下次请求时重新登录
+		a.mutex.Lock()
+		delete(a.sessions, a.fetcher.hostList[i])
+		a.mutex.Unlock()
+		errs = append(errs, err)
+		if method != http.MethodGet && !isDialError(err) {
+			break
+		}
+	}
+	return fmt.Errorf("%v %v [errs:%v]", method, path, errs)
+}
+
+// 连接服务端失败, 请求一定没有到达服务端
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (a *Admin) send(ctx context.Context, hostIndex int, method, action, path string, form map[string]string, resp *adminResp) error {
+	start := time.Now()
+	reqCtx, span := a.fetcher.startSpan(ctx, action, hostIndex)
+	req := a.fetcher.newMethodRequest(reqCtx, method, a.fetcher.getUrls(path)[hostIndex])
+	req.Client.Jar = a.jar
+	if form != nil {
+		data := make(map[string]interface{}, len(form))
+		for k, v := range form {
+			data[k] = v
+		}
+		req = req.Type(gorequest.TypeForm).Send(data)
+	}
+	httpResp, _, errs := req.EndStruct(resp)
+	var err error
+	if len(errs) > 0 {
+		err = errs[0]
+	} else if resp.Success != STRING_TRUE {
+		err = fmt.Errorf("%v", resp.Message)
+	} else if httpResp.StatusCode >= http.StatusBadRequest {
+		err = fmt.Errorf("http status [status:%v]", httpResp.StatusCode)
+	}
+	if err != nil {
+		a.fetcher.observe(span, action, hostIndex, start, []error{err})
+		return err
+	}
+	a.fetcher.observe(span, action, hostIndex, start, nil)
+	return nil
+}
+
+func (a *Admin) entityId(ctx context.Context, action, name string) (int, error) {
+	resp := &adminResp{}
+	if err := a.do(ctx, http.MethodGet, action, action, nil, resp); err != nil {
+		return 0, err
+	}
+	for _, e := range resp.Page.Results {
+		if e.Name == name {
+			return e.Id, nil
+		}
+	}
+	return 0, fmt.Errorf("not found [action:%v] [name:%v]", action, name)
+}
+
+// 新建配置时需要的 appId、version 和 envId
+func (a *Admin) newForm(ctx context.Context, app, version, env string) (map[string]string, error) {
+	if a.dryRun {
+		return map[string]string{"app": app, "version": version, "env": env}, nil
+	}
+	appId, err := a.entityId(ctx, DISCONF_APP_LIST_ACTION, app)
+	if err != nil {
+		return nil, err
+	}
+	envId, err := a.entityId(ctx, DISCONF_ENV_LIST_ACTION, env)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"appId": strconv.Itoa(appId), "version": version, "envId": strconv.Itoa(envId)}, nil
+}
+
+// 服务端当前的配置, 不存在时为 nil
+func (a *Admin) find(ctx context.Context, app, version, env, name string, disconfType int) (*Result, error) {
+	confs, errs := a.fetcher.GetAllConf(ctx, fmt.Sprintf(SUFFIX_PREFIX_URL, app, env, version))
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("get all conf [errs:%v]", errs)
+	}
+	for _, conf := range confs {
+		if conf.Name == name && conf.Genre == disconfType {
+			return conf, nil
+		}
+	}
+	return nil, nil
+}
+
+func (a *Admin) execute(ctx context.Context, action string, act *AdminAction) (*AdminAction, error) {
+	act.DryRun = a.dryRun
+	act.secretKeys = a.secretKeys
+	if a.dryRun {
+		return act, nil
+	}
+	if err := a.do(ctx, act.Method, action, act.Path, act.Form, &adminResp{}); err != nil {
+		return act, err
+	}
+	return act, nil
+}
+
+// 新建或更新配置项, 更新后服务端会通知客户端; 值没有变化时返回 nil
+func (a *Admin) SetItem(ctx context.Context, app, version, env, key, value string) (*AdminAction, error) {
+	conf, err := a.find(ctx, app, version, env, key, DISCONF_TYPE_ITEM)
+	if err != nil {
+		return nil, err
+	}
+	if conf != nil {
+		if conf.Value == value {
+			return nil, nil
+		}
+		return a.execute(ctx, DISCONF_WEB_ITEM_ACTION, &AdminAction{Method: http.MethodPut,
+			Path: fmt.Sprintf("%v/%v", DISCONF_WEB_ITEM_ACTION, conf.Id), Form: map[string]string{"value": value}, Key: key})
+	}
+	form, err := a.newForm(ctx, app, version, env)
+	if err != nil {
+		return nil, err
+	}
+	form["key"], form["value"] = key, value
+	return a.execute(ctx, DISCONF_WEB_ITEM_ACTION, &AdminAction{Method: http.MethodPost, Path: DISCONF_WEB_ITEM_ACTION, Form: form, Key: key})
+}
+
+// 新建或更新配置文件, 更新后服务端会通知客户端; 内容没有变化时返回 nil
+func (a *Admin) SetFile(ctx context.Context, app, version, env, name string, content []byte) (*AdminAction, error) {
+	conf, err := a.find(ctx, app, version, env, name, DISCONF_TYPE_FILE)
+	if err != nil {
+		return nil, err
+	}
+	if conf != nil {
+		if conf.Value == string(content) {
+			return nil, nil
+		}
+		return a.execute(ctx, DISCONF_WEB_FILETEXT_ACTION, &AdminAction{Method: http.MethodPut,
+			Path: fmt.Sprintf("%v/%v", DISCONF_WEB_FILETEXT_ACTION, conf.Id), Form: map[string]string{"fileContent": string(content)}, Key: name})
+	}
+	form, err := a.newForm(ctx, app, version, env)
+	if err != nil {
+		return nil, err
+	}
+	form["fileName"], form["fileContent"] = name, string(content)
+	return a.execute(ctx, DISCONF_WEB_FILETEXT_ACTION, &AdminAction{Method: http.MethodPost, Path: DISCONF_WEB_FILETEXT_ACTION, Form: form, Key: name})
+}
+
+// 删除配置项或配置文件, 不存在时返回 nil
+func (a *Admin) Delete(ctx context.Context, app, version, env, name string, disconfType int) (*AdminAction, error) {
+	conf, err := a.find(ctx, app, version, env, name, disconfType)
+	if err != nil || conf == nil {
+		return nil, err
+	}
+	return a.execute(ctx, DISCONF_WEB_CONFIG_ACTION, &AdminAction{Method: http.MethodDelete,
+		Path: fmt.Sprintf("%v/%v", DISCONF_WEB_CONFIG_ACTION, conf.Id), Key: name})
+}
+
+// 与 disconf-web 相同, 把 value 写入 key 的 zk 节点以通知所有客户端重新加载
+// 用于服务端没有自动通知 (如直接修改了数据库) 时, 节点不存在时先创建.
+// zk 节点所有人可读, 敏感配置项和 properties 文件中的敏感值掩码后写入, 客户端收到通知后从服务端获取明文
+func (a *Admin) Notify(watch IWatch, key string, disconfType int, value []byte) (*AdminAction, error) {
+	monitorPath, err := watch.GetBaseUrl(key, disconfType)
+	if err != nil {
+		return nil, err
+	}
+	act := &AdminAction{Method: ZK_SET_METHOD, Path: monitorPath, DryRun: a.dryRun, Key: key, secretKeys: a.secretKeys}
+	if a.dryRun {
+		return act, nil
+	}
+	path := EMPTY_STRING
+	for _, node := range strings.Split(strings.Trim(monitorPath, "/"), "/") {
+		path += "/" + node
+		if err := watch.CreateZkPath(path, 0, nil); err != nil {
+			return act, fmt.Errorf("create zk path [path:%v] [err:%v]", path, err)
+		}
+	}
+	value, err = a.maskNotify(key, disconfType, value)
+	if err != nil {
+		return act, err
+	}
+	if err := watch.SetZkValue(monitorPath, value); err != nil {
+		return act, fmt.Errorf("set zk value [path:%v] [err:%v]", monitorPath, err)
+	}
+	return act, nil
+}
+
+func (a *Admin) maskNotify(key string, disconfType int, value []byte) ([]byte, error) {
+	if disconfType == DISCONF_TYPE_ITEM {
+		return []byte(MaskValue(key, string(value), a.secretKeys...)), nil
+	}
+	if !strings.HasSuffix(key, FILE_PROPERTIES) {
+		return value, nil
+	}
+	masked, err := (&Store{secretKeys: a.secretKeys}).maskProperties(key, value)
+	if err != nil {
+		return nil, fmt.Errorf("mask file [fileName:%v] [err:%v]", key, err)
+	}
+	return masked, nil
+}
+
+// 如 PUT /api/web/config/item/1 value=3s, 过长的值和文件内容只打印长度, 敏感配置项和 ENC(...) 的值掩码
+func (act *AdminAction) String() string {
+	parts := []string{act.Method, act.Path}
+	keys := make([]string, 0, len(act.Form))
+	for k := range act.Form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := act.Form[k]
+		switch {
+		case k == "value":
+			v = MaskValue(act.Key, v, act.secretKeys...)
+		case k == "fileContent":
+			// 文件中任意位置都可能有敏感值
+			v = fmt.Sprintf("<%v bytes>", len(v))
+		}
+		if len(v) > ADMIN_FORM_VALUE_MAX || strings.ContainsAny(v, "\r\n") {
+			v = fmt.Sprintf("<%v bytes>", len(v))
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, " ")
+}
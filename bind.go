@@ -0,0 +1,121 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// 绑定配置的结构体, 多个结构体共用一个客户端的 zk 连接、http 请求和热加载
+type target struct {
+	conf interface{}
+	// 字段 conf 标签的前缀, 如前缀为 "mysql." 时标签 username 对应 key mysql.username
+	prefix string
+	// 只接收该配置文件中的值, 为空时接收所有配置项和配置文件
+	file string
+}
+
+type BindOption func(*target)
+
+const FILE_KEY_SPLIT = "/"
+
+func WithBindPrefix(prefix string) BindOption {
+	return func(t *target) {
+		t.prefix = prefix
+	}
+}
+
+// 只绑定某个配置文件中的 key, 不同文件中的同名 key 可以分别绑定到不同结构体
+// WithSubscription 订阅的文件为 <app>_<version>_<env>/<fileName>
+func WithBindFile(fileName string) BindOption {
+	return func(t *target) {
+		t.file = fileName
+	}
+}
+
+// 绑定另一个结构体, 立即设置已加载的值, 之后与 NewClient 的 conf 一起热加载
+func (c *Client) Bind(conf interface{}, opts ...BindOption) error {
+	t := &target{conf: conf}
+	for _, o := range opts {
+		o(t)
+	}
+	if err := checkTarget(conf); err != nil {
+		return err
+	}
+	return c.store.bind(t)
+}
+
+func checkTarget(conf interface{}) error {
+	typ := reflect.TypeOf(conf)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("conf must be a pointer to struct [type:%v]", typ)
+	}
+	return nil
+}
+
+func (s *Store) bind(t *target) error {
+	allocDynamicFields(t.conf)
+	s.mutex.Lock()
+	s.targets = append(s.targets, t)
+	var errs []error
+	for _, key := range t.keys() {
+		errs = append(errs, s.resolveTarget(t, key, INIT_CONF, false)...)
+	}
+	s.mutex.Unlock()
+	s.notify()
+	if len(errs) > 0 {
+		return fmt.Errorf("bind [conf:%T] [errs:%v]", t.conf, errs)
+	}
+	return nil
+}
+
+// 绑定到 key 的字段下标
+func (t *target) fields(key string) []int {
+	elems := reflect.TypeOf(t.conf).Elem()
+	fields := []int{}
+	for i := 0; i < elems.NumField(); i++ {
+		if tag := elems.Field(i).Tag.Get(CONF_TAG); tag != EMPTY_STRING && t.prefix+tag == key {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
+func (t *target) keys() []string {
+	elems := reflect.TypeOf(t.conf).Elem()
+	keys := []string{}
+	for i := 0; i < elems.NumField(); i++ {
+		if tag := elems.Field(i).Tag.Get(CONF_TAG); tag != EMPTY_STRING {
+			keys = append(keys, t.prefix+tag)
+		}
+	}
+	return keys
+}
+
+// 限定文件的结构体单独记录来源
+func (t *target) originKey(key string) string {
+	if t.file == EMPTY_STRING {
+		return key
+	}
+	return t.file + FILE_KEY_SPLIT + key
+}
+
+// 结构体的 key 的原始值, 覆盖值优先, 调用方需持有 mutex
+func (s *Store) targetValue(t *target, key string) (string, origin, bool) {
+	if t.file == EMPTY_STRING {
+		return s.rawValue(key)
+	}
+	if value, o, ok := s.override(key); ok {
+		return value, o, true
+	}
+	if r, ok := s.canary.values[key]; ok {
+		return r.value, r.origin, true
+	}
+	r, ok := s.fileRaws[t.file][key]
+	return r.value, r.origin, ok
+}
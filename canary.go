@@ -0,0 +1,207 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 灰度规则, 匹配当前实例时 Values 和 File 中的值覆盖基础配置:
+//
+//	[{"name": "timeout-trial", "percentage": 5, "values": {"timeout": "3s"}},
+//	 {"name": "zone-a", "labels": {"zone": "a"}, "ips": ["10.0.1.0/24"], "file": "db.canary.properties"}]
+//
+// labels、instances、ips 和 percentage 都设置时需要同时满足, 都不设置时匹配所有实例
+// percentage 按 规则名+实例 host:port (设置了 WithInstanceId 时为实例 id) 的哈希稳定分桶, 重启后不变
+// 多个规则匹配同一个 key 时靠前的规则优先, 同一规则中 Values 优先于 File
+type CanaryRule struct {
+	Name string `json:"name"`
+	// 匹配实例的 metadata, 见 WithInstanceMetadata
+	Labels map[string]string `json:"labels,omitempty"`
+	// 匹配实例的 host、host:port 或实例 id, 支持通配符
+	Instances []string `json:"instances,omitempty"`
+	// 匹配实例的 ip 或网段
+	Ips        []string          `json:"ips,omitempty"`
+	Percentage *float64          `json:"percentage,omitempty"`
+	Values     map[string]string `json:"values,omitempty"`
+	// 以 CANARY_FILE_SUFFIX 结尾的配置文件
+	File string `json:"file,omitempty"`
+}
+
+const (
+	SOURCE_CANARY = "canary"
+	// 灰度配置文件只作为规则的 File 使用, 不加载到基础配置
+	CANARY_FILE_SUFFIX = ".canary.properties"
+)
+
+// 从配置项 key 读取灰度规则 (CanaryRule 的 json 数组), 规则变化后重新计算生效的值
+// 生效的规则写入实例状态的 canary 中, 调试接口中来源为 canary, File 为规则名
+func WithCanary(key string) ClientOption {
+	return func(c *Client) {
+		c.canaryKey = key
+	}
+}
+
+func ParseCanaryRules(value string) ([]CanaryRule, error) {
+	rules := []CanaryRule{}
+	if strings.TrimSpace(value) == EMPTY_STRING {
+		return rules, nil
+	}
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("parse canary rules [err:%v]", err)
+	}
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.Name == EMPTY_STRING {
+			return nil, fmt.Errorf("canary rule without name")
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("duplicate canary rule [name:%v]", rule.Name)
+		}
+		seen[rule.Name] = true
+		if rule.File != EMPTY_STRING && !strings.HasSuffix(rule.File, CANARY_FILE_SUFFIX) {
+			return nil, fmt.Errorf("canary file must end with %v [name:%v] [file:%v]", CANARY_FILE_SUFFIX, rule.Name, rule.File)
+		}
+		if _, err := checkFlag(rule.flag()); err != nil {
+			return nil, fmt.Errorf("check canary rule [name:%v] [err:%v]", rule.Name, err)
+		}
+	}
+	return rules, nil
+}
+
+// 用 FeatureFlag 匹配 instances、ips 和 percentage
+func (r *CanaryRule) flag() *FeatureFlag {
+	flag := &FeatureFlag{Enabled: true, Percentage: FLAG_PERCENT_MAX, Instances: r.Instances, Ips: r.Ips}
+	if r.Percentage != nil {
+		flag.Percentage = *r.Percentage
+	}
+	return flag
+}
+
+// 规则是否匹配 identity 对应的实例
+func (r *CanaryRule) Match(identity *Identity) bool {
+	if identity == nil {
+		return false
+	}
+	for k, v := range r.Labels {
+		if identity.Metadata[k] != v {
+			return false
+		}
+	}
+	flag := r.flag()
+	if (len(flag.Instances) > 0 || len(flag.Ips) > 0) && !flag.matchInstance(identity) {
+		return false
+	}
+	if flag.Percentage >= FLAG_PERCENT_MAX {
+		return true
+	}
+	return float64(flagBucket(r.Name, identity.bucketKey())) < flag.Percentage*FLAG_BUCKETS/FLAG_PERCENT_MAX
+}
+
+// 规则 Values 中敏感 key 的值替换为掩码, 无法解析时整体掩码, 调用方需持有 mutex
+func (s *Store) maskCanaryRules(value string) string {
+	rules, err := ParseCanaryRules(value)
+	if err != nil {
+		return SECRET_MASK
+	}
+	changed := false
+	for _, rule := range rules {
+		for key := range rule.Values {
+			if s.isSecretLocked(key) {
+				rule.Values[key] = SECRET_MASK
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return value
+	}
+	masked, err := json.Marshal(rules)
+	if err != nil {
+		return SECRET_MASK
+	}
+	return string(masked)
+}
+
+// 灰度规则和文件变化后的状态
+type canaryState struct {
+	rules []CanaryRule
+	files map[string]map[string]string
+	// 当前实例生效的值
+	values map[string]rawValue
+}
+
+// 设置规则并返回生效值变化的 key, 调用方需持有 mutex
+func (s *Store) setCanaryRules(value string) ([]string, error) {
+	rules, err := ParseCanaryRules(value)
+	if err != nil {
+		return nil, err
+	}
+	s.canary.rules = rules
+	return s.computeCanary(), nil
+}
+
+// 设置灰度文件并返回生效值变化的 key, 调用方需持有 mutex
+func (s *Store) setCanaryFile(fileName string, fileMap map[string]string) []string {
+	if s.canary.files == nil {
+		s.canary.files = make(map[string]map[string]string)
+	}
+	s.canary.files[fileName] = fileMap
+	return s.computeCanary()
+}
+
+func (s *Store) computeCanary() []string {
+	values := make(map[string]rawValue)
+	for i := len(s.canary.rules) - 1; i >= 0; i-- {
+		rule := s.canary.rules[i]
+		if !rule.Match(s.identity) {
+			continue
+		}
+		o := origin{source: SOURCE_CANARY, file: rule.Name}
+		for key, value := range s.canary.files[rule.File] {
+			values[key] = rawValue{value: value, origin: o}
+		}
+		for key, value := range rule.Values {
+			values[key] = rawValue{value: value, origin: o}
+		}
+	}
+	changed := []string{}
+	for key, r := range values {
+		if old, ok := s.canary.values[key]; !ok || old != r {
+			changed = append(changed, key)
+		}
+	}
+	for key := range s.canary.values {
+		if _, ok := values[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	s.canary.values = values
+	return changed
+}
+
+// 当前实例生效的灰度 key 和规则名
+func (s *Store) canaryKeys() map[string]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.canary.values) == 0 {
+		return nil
+	}
+	keys := make(map[string]string, len(s.canary.values))
+	for key, r := range s.canary.values {
+		keys[key] = r.origin.file
+	}
+	return keys
+}
+
+func (s *Store) isCanaryFile(fileName string) bool {
+	return s.canaryKey != EMPTY_STRING && strings.HasSuffix(fileName, CANARY_FILE_SUFFIX)
+}
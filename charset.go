@@ -0,0 +1,186 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const (
+	CHARSET_UTF8       = "utf-8"
+	CHARSET_GBK        = "gbk"
+	CHARSET_GB18030    = "gb18030"
+	CHARSET_BIG5       = "big5"
+	CHARSET_ISO_8859_1 = "iso-8859-1"
+)
+
+var charsets = map[string]encoding.Encoding{
+	CHARSET_UTF8:       encoding.Nop,
+	"utf8":             encoding.Nop,
+	CHARSET_GBK:        simplifiedchinese.GBK,
+	"gb2312":           simplifiedchinese.GBK,
+	CHARSET_GB18030:    simplifiedchinese.GB18030,
+	CHARSET_BIG5:       traditionalchinese.Big5,
+	CHARSET_ISO_8859_1: charmap.ISO8859_1,
+	"latin1":           charmap.ISO8859_1,
+}
+
+var (
+	BOM_UTF8     = []byte{0xef, 0xbb, 0xbf}
+	BOM_UTF16_LE = []byte{0xff, 0xfe}
+	BOM_UTF16_BE = []byte{0xfe, 0xff}
+)
+
+// 所有 properties 文件的编码, 默认 utf-8
+// 设置编码后文件中 Java 风格的 \uXXXX 转义也会被还原
+func WithCharset(charset string) ClientOption {
+	return func(c *Client) {
+		c.charset = charset
+	}
+}
+
+// 单个 properties 文件的编码, 优先于 WithCharset
+func WithFileCharset(fileName, charset string) ClientOption {
+	return func(c *Client) {
+		if c.fileCharsets == nil {
+			c.fileCharsets = make(map[string]string)
+		}
+		c.fileCharsets[fileName] = charset
+	}
+}
+
+func checkCharsets(charset string, fileCharsets map[string]string) error {
+	if _, ok := lookupCharset(charset); charset != EMPTY_STRING && !ok {
+		return fmt.Errorf("unknown charset [charset:%v]", charset)
+	}
+	for fileName, c := range fileCharsets {
+		if _, ok := lookupCharset(c); !ok {
+			return fmt.Errorf("unknown charset [fileName:%v] [charset:%v]", fileName, c)
+		}
+	}
+	return nil
+}
+
+func lookupCharset(charset string) (encoding.Encoding, bool) {
+	e, ok := charsets[strings.ToLower(strings.TrimSpace(charset))]
+	return e, ok
+}
+
+func (s *Store) fileCharset(fileName string) string {
+	return charsetOf(s.charset, s.fileCharsets, fileName)
+}
+
+// WithFileCharset 指定的编码优先, 其次为 WithCharset
+func charsetOf(charset string, fileCharsets map[string]string, fileName string) string {
+	if c, ok := fileCharsets[fileName]; ok {
+		return c
+	}
+	return charset
+}
+
+// 转换为 utf-8, 有 BOM 时按 BOM 识别编码, 忽略配置的编码
+// 返回的 bool 表示是否按 Java 风格还原 \uXXXX 转义, 转义在拆分 key/value 后还原
+func decodeProperties(data []byte, charset string) ([]byte, bool, error) {
+	switch {
+	case bytes.HasPrefix(data, BOM_UTF8):
+		data = data[len(BOM_UTF8):]
+	case bytes.HasPrefix(data, BOM_UTF16_LE) || bytes.HasPrefix(data, BOM_UTF16_BE):
+		decoded, err := unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM).NewDecoder().Bytes(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("decode utf-16 [err:%v]", err)
+		}
+		data = decoded
+	case charset != EMPTY_STRING:
+		e, ok := lookupCharset(charset)
+		if !ok {
+			return nil, false, fmt.Errorf("unknown charset [charset:%v]", charset)
+		}
+		decoded, err := e.NewDecoder().Bytes(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("decode [charset:%v] [err:%v]", charset, err)
+		}
+		data = decoded
+	default:
+		return data, false, nil
+	}
+	return data, true, nil
+}
+
+// 与 decodeProperties 相反, 有 BOM 的文件写为带 BOM 的 utf-8, 否则按配置的编码编码
+func encodeProperties(data, original []byte, charset string) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(original, BOM_UTF8) || bytes.HasPrefix(original, BOM_UTF16_LE) || bytes.HasPrefix(original, BOM_UTF16_BE):
+		return append(append([]byte{}, BOM_UTF8...), data...), nil
+	case charset != EMPTY_STRING:
+		e, ok := lookupCharset(charset)
+		if !ok {
+			return nil, fmt.Errorf("unknown charset [charset:%v]", charset)
+		}
+		encoded, err := e.NewEncoder().Bytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("encode [charset:%v] [err:%v]", charset, err)
+		}
+		return encoded, nil
+	}
+	return data, nil
+}
+
+// 还原 \uXXXX 转义, 包括代理对, 不合法的转义原样保留
+// 只用于拆分后的 key 或 value, 转义出的 = : 和换行不会改变拆分结果
+func unescapeUnicode(s string) string {
+	if !strings.Contains(s, `\u`) {
+		return s
+	}
+	data := []byte(s)
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(data); i++ {
+		// \\u 是转义的反斜杠, 不是 unicode 转义
+		if data[i] == '\\' && i+1 < len(data) && data[i+1] == '\\' {
+			buf.Write(data[i : i+2])
+			i++
+			continue
+		}
+		r, ok := parseUnicodeEscape(data[i:])
+		if !ok {
+			buf.WriteByte(data[i])
+			continue
+		}
+		i += 5
+		if utf16.IsSurrogate(r) {
+			if r2, ok := parseUnicodeEscape(data[i+1:]); ok {
+				if pair := utf16.DecodeRune(r, r2); pair != utf8.RuneError {
+					r = pair
+					i += 6
+				}
+			}
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func parseUnicodeEscape(data []byte) (rune, bool) {
+	if len(data) < 6 || data[0] != '\\' || data[1] != 'u' {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(string(data[2:6]), 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return rune(v), true
+}
@@ -7,12 +7,16 @@
 package disconf_client
 
 import (
+	"context"
 	"strings"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"sync"
-	"github.com/sirupsen/logrus"
 	"github.com/samuel/go-zookeeper/zk"
+	"github.com/sirupsen/logrus"
 	"encoding/json"
+	"time"
 )
 
 type Client struct {
@@ -29,6 +33,34 @@ type Client struct {
 	fetcher           IFetcher
 	watch             IWatch
 	store             *Store
+	host              string
+	port              string
+	instanceId        string
+	hostResolver      HostResolver
+	metadata          map[string]string
+	identity          *Identity
+	status            *statusReporter
+	zkConf            zkConfig
+	metrics           MetricsCollector
+	logger            Logger
+	tracer            Tracer
+	health            *Health
+	secretKeys        []string
+	decrypters        map[string]Decrypter
+	overrides         []overrideLayer
+	charset           string
+	fileCharsets      map[string]string
+	envPlaceholders   bool
+	// 找不到的占位符是否报错
+	strictPlaceholders bool
+	// 第一个为客户端自身的 app/version/env
+	subscriptions     []*subscription
+	subscriptionConfs []subscriptionConf
+	// 按 key 读取配置: Get、GetInt、Keys、All、Sub 等
+	*View
+	flags flagCache
+	// 灰度规则所在的配置项
+	canaryKey string
 }
 
 type ClientOption func(*Client)
@@ -57,32 +89,161 @@ func WithIgnore(ignore string) ClientOption {
 	}
 }
 
-func NewConf(serverHost, app, version, env string, enableRemote, debug bool, conf interface{}, opts ... ClientOption) error {
-	defaultClient := &Client{
-		retryTimes:        RETRY_TIMES,
-		retrySleepSeconds: RETRY_SLEEP_SECONDS,
-		downloadDir:       DEFAULT_DOWNLOAD_DIR,
-		ignore:            EMPTY_STRING,
+// 实例注册到 zookeeper 的 host, 不设置时由 HostResolver 解析
+func WithHost(host string) ClientOption {
+	return func(c *Client) {
+		c.host = host
 	}
-	for _, o := range opts {
-		o(defaultClient)
+}
+
+func WithPort(port string) ClientOption {
+	return func(c *Client) {
+		c.port = port
 	}
-	var fetcher IFetcher
-	var watch IWatch
-	fetcher = &Fetcher{
-		retryTime:         defaultClient.retryTimes,
-		retrySleepSeconds: defaultClient.retrySleepSeconds,
-		downloadDir:       defaultClient.downloadDir,
-		hostList:          strings.Split(serverHost, COMMA_SPLIT),
+}
+
+func WithInstanceId(instanceId string) ClientOption {
+	return func(c *Client) {
+		c.instanceId = instanceId
 	}
-	zkHosts, errs := fetcher.getZkHost()
-	if len(errs) > 0 {
-		return fmt.Errorf("get zk hosts [errs:%v]", errs)
+}
+
+func WithHostResolver(resolver HostResolver) ClientOption {
+	return func(c *Client) {
+		c.hostResolver = resolver
+	}
+}
+
+func WithInstanceMetadata(metadata map[string]string) ClientOption {
+	return func(c *Client) {
+		c.metadata = metadata
+	}
+}
+
+// zookeeper digest 认证, auth 格式为 user:password, 重连时会重新提交
+func WithZkDigestAuth(user, password string) ClientOption {
+	return WithZkAuth(ZK_SCHEME_DIGEST, user+":"+password)
+}
+
+func WithZkAuth(scheme, auth string) ClientOption {
+	return func(c *Client) {
+		c.zkConf.auths = append(c.zkConf.auths, zkAuth{scheme: scheme, auth: []byte(auth)})
+	}
+}
+
+// 所有 zk 路径的前缀, 如 /prod
+func WithZkChroot(chroot string) ClientOption {
+	return func(c *Client) {
+		c.zkConf.chroot = "/" + strings.Trim(chroot, "/")
+		if c.zkConf.chroot == "/" {
+			c.zkConf.chroot = EMPTY_STRING
+		}
+	}
+}
+
+// 创建目录节点时使用的 ACL, 默认 zk.WorldACL(zk.PermAll)
+func WithZkAcl(acl []zk.ACL) ClientOption {
+	return func(c *Client) {
+		c.zkConf.acl = acl
+	}
+}
+
+// 创建实例临时节点时使用的 ACL, 默认与 WithZkAcl 相同
+func WithZkEphemeralAcl(acl []zk.ACL) ClientOption {
+	return func(c *Client) {
+		c.zkConf.ephemeralAcl = acl
+	}
+}
+
+// 替换默认的 Fetcher, 用于测试或其他传输方式
+func WithFetcher(fetcher IFetcher) ClientOption {
+	return func(c *Client) {
+		c.fetcher = fetcher
+	}
+}
+
+// 替换默认的 Watch, 设置后不再从服务端获取 zk hosts
+func WithWatcher(watch IWatch) ClientOption {
+	return func(c *Client) {
+		c.watch = watch
+	}
+}
+
+// 采集运行指标, 如 NewPrometheusMetrics("disconf"); 为 nil 时不采集
+func WithMetrics(metrics MetricsCollector) ClientOption {
+	return func(c *Client) {
+		if metrics != nil {
+			c.metrics = metrics
+		}
+	}
+}
+
+// 替换默认的 logrus 全局实例, 如 disconfslog.NewLogger(slog.Default()); 为 nil 时仍使用默认实例
+func WithLogger(logger Logger) ClientOption {
+	return func(c *Client) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+// 链路追踪, 覆盖初始加载、热加载、http 请求和 zk 操作; 为 nil 时不追踪
+func WithTracer(tracer Tracer) ClientOption {
+	return func(c *Client) {
+		if tracer != nil {
+			c.tracer = tracer
+		}
+	}
+}
+
+func NewConf(serverHost, app, version, env string, enableRemote, debug bool, conf interface{}, opts ... ClientOption) error {
+	_, err := NewClient(serverHost, app, version, env, enableRemote, debug, conf, opts...)
+	return err
+}
+
+// 与 NewConf 相同, 返回的 Client 可用于查询健康状态等
+func NewClient(serverHost, app, version, env string, enableRemote, debug bool, conf interface{}, opts ... ClientOption) (*Client, error) {
+	defaultClient := newOptions(opts)
+	if err := checkCharsets(defaultClient.charset, defaultClient.fileCharsets); err != nil {
+		return nil, err
+	}
+	// conf 为 nil 时可以之后用 Bind 绑定
+	var targets []*target
+	if conf != nil {
+		if err := checkTarget(conf); err != nil {
+			return nil, err
+		}
+		allocDynamicFields(conf)
+		targets = append(targets, &target{conf: conf})
 	}
-	watch, err := newWatch(zkHosts, app, version, env, debug)
+	logger := defaultClient.logger.With(F(LOG_FIELD_APP, app), F(LOG_FIELD_ENV, env), F(LOG_FIELD_VERSION, version))
+	health := defaultClient.health
+	if health == nil {
+		health = NewHealth()
+	}
+	metrics := multiMetrics{defaultClient.metrics, health}
+	// 自定义 Watch 时也需要完整的身份, 用于实例状态和灰度分桶
+	identity, err := resolveIdentity(defaultClient.host, defaultClient.port, defaultClient.instanceId,
+		defaultClient.hostResolver, defaultClient.metadata)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	fetcher := defaultClient.fetcher
+	if fetcher == nil {
+		fetcher = newFetcher(serverHost, defaultClient, metrics, logger)
+	}
+	watch := defaultClient.watch
+	if watch == nil {
+		zkHosts, errs := fetcher.GetZkHost(context.Background())
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("get zk hosts [errs:%v]", errs)
+		}
+		watch, err = newWatch(zkHosts, app, version, env, debug, identity, defaultClient.zkConf, metrics, logger)
+		if err != nil {
+			return nil, err
+		}
 	}
+	health.attach(enableRemote, watch)
 	client := &Client{
 		retryTimes:        defaultClient.retryTimes,
 		retrySleepSeconds: defaultClient.retrySleepSeconds,
@@ -95,13 +256,56 @@ func NewConf(serverHost, app, version, env string, enableRemote, debug bool, con
 		ignore:            defaultClient.ignore,
 		debug:             debug,
 		fetcher:           fetcher,
-		store:             &Store{conf},
+		store:             &Store{targets: targets, metrics: metrics, secretKeys: defaultClient.secretKeys,
+			decrypters: defaultClient.decrypters, overrides: defaultClient.overrides,
+			charset: defaultClient.charset, fileCharsets: defaultClient.fileCharsets,
+			envPlaceholders: defaultClient.envPlaceholders, strictPlaceholders: defaultClient.strictPlaceholders,
+			canaryKey: defaultClient.canaryKey, identity: identity},
 		watch:             watch,
+		host:              identity.Host,
+		port:              identity.Port,
+		instanceId:        identity.Id,
+		hostResolver:      defaultClient.hostResolver,
+		metadata:          defaultClient.metadata,
+		identity:          identity,
+		status:            newStatusReporter(identity),
+		zkConf:            defaultClient.zkConf,
+		metrics:           metrics,
+		logger:            logger,
+		tracer:            defaultClient.tracer,
+		health:            health,
 	}
+	client.subscriptions, err = newSubscriptions(app, version, env, watch, client.status, identity, defaultClient.subscriptionConfs)
+	if err != nil {
+		return nil, err
+	}
+	client.store.subscriptions = subscriptionNames(client.subscriptions)
+	client.View = &View{store: client.store, logger: client.logger}
 	if err := client.initConf(); err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	health.setReady()
+	return client, nil
+}
+
+
+// 应用 opts 后的默认配置
+func newOptions(opts []ClientOption) *Client {
+	defaultClient := &Client{
+		retryTimes:        RETRY_TIMES,
+		retrySleepSeconds: RETRY_SLEEP_SECONDS,
+		downloadDir:       DEFAULT_DOWNLOAD_DIR,
+		ignore:            EMPTY_STRING,
+		port:              PORT,
+		hostResolver:      DefaultHostResolver,
+		metrics:           noopMetrics{},
+		logger:            NewLogrusLogger(logrus.StandardLogger()),
+		tracer:            noopTracer{},
+	}
+	for _, o := range opts {
+		o(defaultClient)
+	}
+	return defaultClient
 }
 
 const (
@@ -111,146 +315,255 @@ const (
 	COMMA_SPLIT          = ","
 	SUFFIX_PREFIX_URL    = "?app=%v&env=%v&version=%v"
 	SUFFIX_KEY           = "&key=%v"
+	ZK_SCHEME_DIGEST     = "digest"
 )
 
-func (c *Client) suffixPrefixUrlString() string {
-	return fmt.Sprintf(SUFFIX_PREFIX_URL, c.app, c.env, c.version)
-}
-
 func (c *Client) suffixKeyString(key string) string {
 	return fmt.Sprintf(SUFFIX_KEY, key)
 }
 
-func (c *Client) initConf() error {
+func (c *Client) initConf() (err error) {
+	ctx, span := c.tracer.Start(context.Background(), SPAN_INIT_CONF, F(LOG_FIELD_APP, c.app), F(LOG_FIELD_ENV, c.env),
+		F(LOG_FIELD_VERSION, c.version))
+	defer func() {
+		endSpan(span, err)
+	}()
 	if !c.enableRemote {
-		if err := c.store.loadPropertiesDir(c.downloadDir, c.ignore); err != nil {
+		for _, sub := range c.subscriptions {
+			if err := c.store.loadPropertiesDir(sub.downloadDir(c.downloadDir), c.ignore, sub.name); err != nil {
+				return err
+			}
+		}
+		if err := c.store.resolvePlaceholders(); err != nil {
 			return err
 		}
-		return nil
+		return c.store.applyOverrides()
 	}
-	confs, errs := c.fetcher.getAllConf(c.suffixPrefixUrlString())
-	if len(errs) > 0 {
-		return fmt.Errorf("get all conf from server [errs:%v]", errs)
+	subConfs := make([][]*Result, len(c.subscriptions))
+	for i, sub := range c.subscriptions {
+		confs, errs := c.fetcher.GetAllConf(ctx, sub.suffixPrefixUrl())
+		if len(errs) > 0 {
+			return fmt.Errorf("get all conf from server [app:%v] [env:%v] [version:%v] [errs:%v]", sub.app, sub.env, sub.version, errs)
+		}
+		files := c.downloadFiles(ctx, sub, confs)
+		if err := c.store.loadConf(confs, files, sub.downloadDir(c.downloadDir), c.ignore, sub.name); err != nil {
+			return err
+		}
+		subConfs[i] = confs
 	}
-	if err := c.downloadFiles(confs); err != nil {
+	if err := c.store.resolvePlaceholders(); err != nil {
 		return err
 	}
-	if err := c.store.loadConf(confs, c.downloadDir, c.ignore); err != nil {
+	if err := c.store.applyOverrides(); err != nil {
 		return err
 	}
-	go c.autoLoad(confs)
+	for i, sub := range c.subscriptions {
+		go c.autoLoad(ctx, sub, subConfs[i])
+	}
 	return nil
 }
 
-func (c *Client) autoLoad(confs []*Result) {
-	respChan := make(chan watchResponse, 16)
-	localHostPath, err := c.watch.getLocalHostPath()
+// ctx 为初始加载的 trace context, 创建 zk 节点和注册实例的 span 挂在它下面
+func (c *Client) autoLoad(ctx context.Context, sub *subscription, confs []*Result) {
+	ctx, span := c.tracer.Start(ctx, SPAN_REGISTER, F(LOG_FIELD_APP, sub.app), F(LOG_FIELD_ENV, sub.env),
+		F(LOG_FIELD_VERSION, sub.version))
+	respChan := make(chan WatchResponse, 16)
+	localHostPath, err := sub.watch.GetLocalHostPath()
 	if err != nil {
-		logrus.Errorf("get local hosts path [err:%v]", err)
+		c.logger.Error("get local hosts path", F(LOG_FIELD_ERR, err))
 	}
 	for _, conf := range confs {
 		if ContainString(c.ignore, conf.Name) {
 			continue
 		}
 		if (conf.Genre == DISCONF_TYPE_FILE && strings.HasSuffix(conf.Name, FILE_PROPERTIES)) || conf.Genre == DISCONF_TYPE_ITEM {
-			if err := c.watch.createZkDir(conf.Genre, conf.Name); err != nil {
-				logrus.Errorf("create file or item zk dir [err:%v]", err)
+			key := sub.qualify(conf.Name)
+			if err := sub.watch.CreateZkDir(conf.Genre, conf.Name); err != nil {
+				c.logger.Error("create file or item zk dir", F(LOG_FIELD_KEY, key), F(LOG_FIELD_TYPE, disconfTypeName(conf.Genre)), F(LOG_FIELD_ERR, err))
 			}
-			monitorPath, err := c.watch.getBaseUrl(conf.Name, conf.Genre)
+			monitorPath, err := sub.watch.GetBaseUrl(conf.Name, conf.Genre)
 			if err != nil {
-				logrus.Errorf("get zk base path [err:%v]", err)
+				c.logger.Error("get zk base path", F(LOG_FIELD_KEY, key), F(LOG_FIELD_ERR, err))
 
 			}
 			var byteValue []byte
+			var loadErr error
 			if conf.Genre == DISCONF_TYPE_FILE {
-				fileMap, err := c.store.loadProperties(c.downloadDir, conf.Name, INIT_CONF)
-				byteValue, err = json.Marshal(fileMap)
-				//fmt.Println(string(byteValue))
+				// initConf 已解析过, 本地文件中的敏感值已被掩码, 不再重新读取
+				fileMap, ok := c.store.getFile(key)
+				if !ok {
+					fileMap, loadErr = c.store.loadProperties(sub.downloadDir(c.downloadDir), conf.Name, INIT_CONF,
+						origin{SOURCE_REMOTE_FILE, conf.Name, sub.name})
+				}
+				byteValue, err = json.Marshal(c.store.maskMap(fileMap))
 				if err != nil {
-					logrus.Errorf("marshal value [err:%v]", err)
+					c.logger.Error("marshal value", F(LOG_FIELD_KEY, key), F(LOG_FIELD_ERR, err))
 				}
 			} else {
-				byteValue = []byte(conf.Value)
+				byteValue = []byte(c.store.maskValue(conf.Name, conf.Value))
 			}
-			if err := c.watch.createZkPath(monitorPath+localHostPath, zk.FlagEphemeral, byteValue); err != nil {
-				logrus.Errorf("create zk temp path [err:%v]", err)
+			_, zkSpan := c.tracer.Start(ctx, SPAN_ZK_CREATE, F(LOG_FIELD_KEY, key),
+				F(LOG_FIELD_PATH, monitorPath+localHostPath))
+			err = sub.watch.CreateZkPath(monitorPath+localHostPath, zk.FlagEphemeral, byteValue)
+			endSpan(zkSpan, err)
+			if err != nil {
+				c.logger.Error("create zk temp path", F(LOG_FIELD_KEY, key), F(LOG_FIELD_ERR, err))
+			}
+			_, zkSpan = c.tracer.Start(ctx, SPAN_ZK_VERSION, F(LOG_FIELD_KEY, key), F(LOG_FIELD_PATH, monitorPath))
+			version, err := sub.watch.GetZkVersion(monitorPath)
+			endSpan(zkSpan, err)
+			if err != nil {
+				c.logger.Error("get zk version", F(LOG_FIELD_KEY, key), F(LOG_FIELD_ERR, err))
 			}
-			go c.watch.watchPath(conf.Name, conf.Genre, respChan)
+			sub.status.record(conf.Name, conf.Genre, byteValue, version, loadErr)
+			if loadErr == nil {
+				c.store.setVersion(conf.Name, conf.Genre, version, sub.name)
+				c.metrics.SetConfigUpdated(key, time.Now())
+			}
+			go sub.watch.WatchPath(conf.Name, conf.Genre, respChan)
 		}
 	}
+	c.registerInstance(sub)
+	endSpan(span, nil)
 	for {
 		select {
 		case resp := <-respChan:
-			byteValue,err := c.autoLoadProperties(resp)
-			if err != nil {
-				logrus.Errorf("auto load properties [key:%v] [err:%v]", resp.key, err)
-			}
-			monitorPath, err := c.watch.getBaseUrl(resp.key, resp.disconfType)
-			if err != nil {
-				logrus.Errorf("get zk base path [err:%v]", err)
-			}
-			if err := c.watch.setZkValue(monitorPath+localHostPath, byteValue); err != nil {
-				logrus.Errorf("create zk temp path [err:%v]", err)
-			}
-			go c.watch.watchPath(resp.key, resp.disconfType, respChan)
-			logrus.Infof("auto load [key:%v]", resp.key)
+			c.reload(sub, resp, localHostPath)
+			go sub.watch.WatchPath(resp.Key, resp.DisconfType, respChan)
 		}
 	}
 }
 
-func (c *Client) autoLoadProperties(resp watchResponse) ([]byte, error) {
-	if resp.err != nil {
-		return nil,fmt.Errorf("watch [key:%v] [err:%v]", resp.key, resp.err)
+func (c *Client) reload(sub *subscription, resp WatchResponse, localHostPath string) {
+	key := sub.qualify(resp.Key)
+	ctx, span := c.tracer.Start(context.Background(), SPAN_RELOAD, F(LOG_FIELD_KEY, key),
+		F(LOG_FIELD_TYPE, disconfTypeName(resp.DisconfType)), F(LOG_FIELD_ZK_VERSION, resp.Version))
+	byteValue, loadErr := c.autoLoadProperties(ctx, sub, resp)
+	if loadErr != nil {
+		c.logger.Error("auto load properties", F(LOG_FIELD_KEY, key), F(LOG_FIELD_TYPE, disconfTypeName(resp.DisconfType)), F(LOG_FIELD_ERR, loadErr))
+	}
+	monitorPath, err := sub.watch.GetBaseUrl(resp.Key, resp.DisconfType)
+	if err != nil {
+		c.logger.Error("get zk base path", F(LOG_FIELD_KEY, key), F(LOG_FIELD_ERR, err))
+	}
+	_, zkSpan := c.tracer.Start(ctx, SPAN_ZK_SET, F(LOG_FIELD_KEY, key), F(LOG_FIELD_PATH, monitorPath+localHostPath))
+	err = sub.watch.SetZkValue(monitorPath+localHostPath, byteValue)
+	endSpan(zkSpan, err)
+	if err != nil {
+		c.logger.Error("create zk temp path", F(LOG_FIELD_KEY, key), F(LOG_FIELD_ERR, err))
+	}
+	sub.status.record(resp.Key, resp.DisconfType, byteValue, resp.Version, loadErr)
+	c.metrics.ObserveReload(key, resp.DisconfType, loadErr)
+	if loadErr == nil {
+		c.store.setVersion(resp.Key, resp.DisconfType, resp.Version, sub.name)
+		c.metrics.SetConfigUpdated(key, time.Now())
+	}
+	c.updateInstance(sub)
+	endSpan(span, loadErr)
+	c.logger.Info("auto load", F(LOG_FIELD_KEY, key), F(LOG_FIELD_TYPE, disconfTypeName(resp.DisconfType)), F(LOG_FIELD_ZK_VERSION, resp.Version))
+}
+
+func (c *Client) registerInstance(sub *subscription) {
+	sub.status.setCanary(c.store.canaryKeys())
+	value, err := sub.status.marshal()
+	if err != nil {
+		c.logger.Error("marshal instance status", F(LOG_FIELD_ERR, err))
+		return
+	}
+	if err := sub.watch.RegisterInstance(value); err != nil {
+		c.logger.Error("register instance", F(LOG_FIELD_ERR, err))
 	}
-	if !(resp.disconfType == DISCONF_TYPE_ITEM || resp.disconfType == DISCONF_TYPE_FILE) {
+}
+
+func (c *Client) updateInstance(sub *subscription) {
+	sub.status.setCanary(c.store.canaryKeys())
+	value, err := sub.status.marshal()
+	if err != nil {
+		c.logger.Error("marshal instance status", F(LOG_FIELD_ERR, err))
+		return
+	}
+	if err := sub.watch.UpdateInstance(value); err != nil {
+		c.logger.Error("update instance status", F(LOG_FIELD_ERR, err))
+	}
+}
+
+func (c *Client) autoLoadProperties(ctx context.Context, sub *subscription, resp WatchResponse) ([]byte, error) {
+	if resp.Err != nil {
+		return nil,fmt.Errorf("watch [key:%v] [err:%v]", resp.Key, resp.Err)
+	}
+	if !(resp.DisconfType == DISCONF_TYPE_ITEM || resp.DisconfType == DISCONF_TYPE_FILE) {
 		return nil,fmt.Errorf("disconf type err")
 	}
-	if resp.disconfType == DISCONF_TYPE_ITEM {
-		value, errs := c.fetcher.getValue(c.suffixPrefixUrlString() + c.suffixKeyString(resp.key))
+	if resp.DisconfType == DISCONF_TYPE_ITEM {
+		value, errs := c.fetcher.GetValue(ctx, sub.suffixPrefixUrl() + c.suffixKeyString(resp.Key))
 		if len(errs) > 0 {
-			return nil,fmt.Errorf("get value [key:%v] [errs:%v]", resp.key, errs)
+			return nil,fmt.Errorf("get value [key:%v] [errs:%v]", resp.Key, errs)
 		}
-		if err := c.store.loadItem(resp.key, value, AUTO_CONF); err != nil {
+		if err := c.store.loadItem(resp.Key, value, AUTO_CONF, sub.name); err != nil {
 			return nil,err
 		}
-		return []byte(value),nil
+		return []byte(c.store.maskValue(resp.Key, value)),nil
 	}
-	if errs := c.fetcher.downloadFile(c.suffixPrefixUrlString()+c.suffixKeyString(resp.key), resp.key); len(errs) > 0 {
-		return nil,fmt.Errorf("download file [fileName:%v] [errs:%v]", resp.key, errs)
+	data, err := c.downloadFile(ctx, sub, resp.Key)
+	if err != nil {
+		return nil,err
 	}
-	fileMap, err := c.store.loadProperties(c.downloadDir, resp.key, AUTO_CONF)
+	fileMap, err := c.store.loadPropertiesData(resp.Key, data, AUTO_CONF, origin{SOURCE_REMOTE_FILE, resp.Key, sub.name})
 	if err != nil {
-		return nil,fmt.Errorf("load file properties [fileName:%v] [errs:%v]", resp.key, err)
+		return nil,fmt.Errorf("load file properties [fileName:%v] [errs:%v]", resp.Key, err)
 	}
-	byteValue, err := json.Marshal(fileMap)
+	byteValue, err := json.Marshal(c.store.maskMap(fileMap))
 	if err != nil {
-		logrus.Errorf("marshal value [err:%v]", err)
+		c.logger.Error("marshal value", F(LOG_FIELD_KEY, sub.qualify(resp.Key)), F(LOG_FIELD_ERR, err))
 	}
 
 	return byteValue,nil
 }
 
-func (c *Client) downloadFiles(confs []*Result) error {
-	errs := []error{}
+// 返回下载到的文件内容, 写入本地的副本已掩码; 下载失败的文件只记录日志, 加载时使用本地已有的文件
+func (c *Client) downloadFiles(ctx context.Context, sub *subscription, confs []*Result) map[string][]byte {
+	files := make(map[string][]byte)
 	wg := &sync.WaitGroup{}
 	var mutex sync.Mutex
 	for _, conf := range confs {
 		if conf.Genre == DISCONF_TYPE_FILE {
 			wg.Add(1)
-			go func(fileName string) {
+			go func(key string) {
 				defer wg.Done()
-				if fErrs := c.fetcher.downloadFile(c.suffixPrefixUrlString()+c.suffixKeyString(fileName), fileName); len(fErrs) > 0 {
-					mutex.Lock()
-					errs = append(errs, fErrs...)
-					mutex.Unlock()
+				data, err := c.downloadFile(ctx, sub, key)
+				if err != nil {
+					c.logger.Error("download file from server", F(LOG_FIELD_KEY, sub.qualify(key)), F(LOG_FIELD_ERR, err))
+					return
 				}
+				mutex.Lock()
+				defer mutex.Unlock()
+				files[key] = data
 			}(conf.Name)
 		}
 	}
 	wg.Wait()
+	return files
+}
+
+// 获取文件内容, 敏感值在内存中掩码后再写入下载目录, 返回明文
+func (c *Client) downloadFile(ctx context.Context, sub *subscription, fileName string) ([]byte, error) {
+	data, errs := c.fetcher.GetFile(ctx, sub.suffixPrefixUrl()+c.suffixKeyString(fileName))
 	if len(errs) > 0 {
-		fmt.Errorf("download file from server [errs:%v]", errs)
+		return nil, fmt.Errorf("download file [fileName:%v] [errs:%v]", fileName, errs)
 	}
-	return nil
+	snapshot := data
+	if strings.HasSuffix(fileName, FILE_PROPERTIES) {
+		var err error
+		if snapshot, err = c.store.maskProperties(fileName, data); err != nil {
+			return nil, fmt.Errorf("mask file [fileName:%v] [err:%v]", fileName, err)
+		}
+	}
+	dir := sub.downloadDir(c.downloadDir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("download file [fileName:%v] [err:%v]", fileName, err)
+	}
+	if err := ioutil.WriteFile(dir+fileName, snapshot, 0644); err != nil {
+		return nil, fmt.Errorf("download file [fileName:%v] [err:%v]", fileName, err)
+	}
+	return data, nil
 }
-
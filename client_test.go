@@ -4,12 +4,29 @@
  * @Last Modified by:   llh
  */
 
-package disconf_client
+package disconf_client_test
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
-	"fmt"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+	"github.com/scriptllh/go-disconf-client/disconftest"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
 )
 
 type Conf struct {
@@ -19,21 +36,1317 @@ type Conf struct {
 	TextGBK  string `conf:"textGBK" auto:"true"`
 }
 
-func TestNewConf(t *testing.T) {
-	conf := &Conf{UserName: "2", Password: "d"}
-	if err := NewConf(
-		"http://127.0.0.1",
+func newTestConf(t *testing.T, server *disconftest.Server, conf interface{}, opts ...disconf.ClientOption) func() {
+	_, cleanup := newTestClient(t, server, conf, opts...)
+	return cleanup
+}
+
+func newTestClient(t *testing.T, server *disconftest.Server, conf interface{}, opts ...disconf.ClientOption) (*disconf.Client, func()) {
+	dir, err := ioutil.TempDir("", "disconf")
+	if err != nil {
+		t.Fatalf("temp dir [err:%v]", err)
+	}
+	opts = append([]disconf.ClientOption{
+		disconf.WithDownloadDir(dir + "/"),
+		disconf.WithRetryTimes(0),
+		disconf.WithWatcher(server.Watch()),
+	}, opts...)
+	client, err := disconf.NewClient(
+		server.URL,
 		"disconf_demo",
 		"1_0_0_0",
 		"dev",
 		true,
 		false,
-		conf); err != nil {
+		conf,
+		opts...)
+	if err != nil {
+		t.Fatalf("new conf [err:%v]", err)
+	}
+	return client, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewConf(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\nmysql.password=123456\n"))
+	conf := &Conf{UserName: "2", Password: "d"}
+	defer newTestConf(t, server, conf)()
+	if conf.UserName != "root" || conf.Password != "123456" || conf.A != 1 {
+		t.Fatalf("unexpected conf [conf:%+v]", conf)
+	}
+	if _, err := server.Watch().WaitApplied("a", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+
+	version := server.UpdateItem("a", "2")
+	keyStatus, err := server.Watch().WaitApplied("a", version, 5*time.Second)
+	if err != nil {
+		t.Fatalf("wait item applied [err:%v]", err)
+	}
+	if !keyStatus.Success || conf.A != 2 {
+		t.Fatalf("item not reloaded [status:%+v] [conf:%+v]", keyStatus, conf)
+	}
+
+	version = server.UpdateFile("jdbc.properties", []byte("mysql.username=admin\nmysql.password=654321\n"))
+	if _, err := server.Watch().WaitApplied("jdbc.properties", version, 5*time.Second); err != nil {
+		t.Fatalf("wait file applied [err:%v]", err)
+	}
+	if conf.Password != "654321" || conf.UserName != "root" {
+		t.Fatalf("file not reloaded [conf:%+v]", conf)
+	}
+}
+
+// 下载配置文件总是失败的 fetcher
+type failingDownloadFetcher struct {
+	disconf.IFetcher
+}
+
+func (f failingDownloadFetcher) GetFile(ctx context.Context, suffixUrl string) ([]byte, []error) {
+	return nil, []error{fmt.Errorf("connection refused")}
+}
+
+func TestDownloadFileError(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\n"))
+	fetcher, err := disconf.NewFetcher(server.URL, disconf.WithRetryTimes(0))
+	if err != nil {
+		t.Fatalf("new fetcher [err:%v]", err)
+	}
+	dir, err := ioutil.TempDir("", "disconf")
+	if err != nil {
+		t.Fatalf("temp dir [err:%v]", err)
+	}
+	defer os.RemoveAll(dir)
+	newClient := func(conf *Conf) error {
+		_, err := disconf.NewClient(server.URL, "disconf_demo", "1_0_0_0", "dev", true, false, conf,
+			disconf.WithDownloadDir(dir+"/"), disconf.WithWatcher(server.Watch()),
+			disconf.WithFetcher(failingDownloadFetcher{fetcher}))
+		return err
+	}
+	// 没有本地文件时初始加载失败
+	if err := newClient(&Conf{}); err == nil {
+		t.Fatalf("load without local file")
+	}
+	// 下载失败时使用本地已有的文件
+	if err := ioutil.WriteFile(dir+"/jdbc.properties", []byte("mysql.username=local\n"), 0644); err != nil {
+		t.Fatalf("write file [err:%v]", err)
+	}
+	conf := &Conf{}
+	if err := newClient(conf); err != nil || conf.UserName != "local" {
+		t.Fatalf("local file not loaded [conf:%+v] [err:%v]", conf, err)
+	}
+}
+
+func TestIdentityWithWatcher(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	defer newTestConf(t, server, &Conf{}, disconf.WithHostResolver(func() (string, error) {
+		return "10.0.0.9", nil
+	}))()
+	if _, err := server.Watch().WaitApplied("a", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	status, err := server.Watch().InstanceStatus()
+	if err != nil {
+		t.Fatalf("instance status [err:%v]", err)
+	}
+	if status.Host != "10.0.0.9" || status.Port != disconf.PORT || status.Id == "" {
+		t.Fatalf("identity not resolved [identity:%+v]", status.Identity)
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	metrics := disconf.NewPrometheusMetrics("disconf")
+	conf := &Conf{}
+	defer newTestConf(t, server, conf, disconf.WithMetrics(metrics))()
+	if _, err := server.Watch().WaitApplied("a", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("a", server.UpdateItem("a", "x"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	out := string(metrics.Gather())
+	for _, want := range []string{
+		`disconf_fetch_duration_seconds_count{endpoint="/api/config/list",host="` + server.URL + `"} 1`,
+		`disconf_reloads_total{key="a",type="item"} 1`,
+		`disconf_reload_failures_total{key="a",type="item"} 1`,
+		`disconf_conversion_errors_total{key="a"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("metric not found [want:%v] [out:%v]", want, out)
+		}
+	}
+}
+
+type recordTracer struct {
+	mutex   sync.Mutex
+	spans   []string
+	headers []string
+	// span 名到父 span 名
+	parents map[string]string
+}
+
+type recordSpan struct{}
+
+func (t *recordTracer) Start(ctx context.Context, name string, fields ...disconf.Field) (context.Context, disconf.Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.spans = append(t.spans, name)
+	if parent, ok := ctx.Value(recordSpan{}).(string); ok {
+		t.parents[name] = parent
+	}
+	return context.WithValue(ctx, recordSpan{}, name), recordSpan{}
+}
+
+func (t *recordTracer) Inject(ctx context.Context, header http.Header) {
+	if name, ok := ctx.Value(recordSpan{}).(string); ok {
+		header.Set("X-Test-Span", name)
+	}
+}
+
+func (recordSpan) SetAttributes(fields ...disconf.Field) {}
+
+func (recordSpan) RecordError(err error) {}
+
+func (recordSpan) End() {}
+
+func TestTracer(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	tracer := &recordTracer{parents: make(map[string]string)}
+	defer newTestConf(t, server, &Conf{}, disconf.WithTracer(tracer))()
+	if _, err := server.Watch().WaitApplied("a", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("a", server.UpdateItem("a", "2"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	tracer.mutex.Lock()
+	spans := strings.Join(tracer.spans, ",")
+	parents := make(map[string]string, len(tracer.parents))
+	for span, parent := range tracer.parents {
+		parents[span] = parent
+	}
+	tracer.mutex.Unlock()
+	for _, want := range []string{disconf.SPAN_INIT_CONF, disconf.SPAN_FETCH, disconf.SPAN_RELOAD, disconf.SPAN_ZK_SET} {
+		if !strings.Contains(spans, want) {
+			t.Fatalf("span not found [want:%v] [spans:%v]", want, spans)
+		}
+	}
+	for span, parent := range map[string]string{
+		disconf.SPAN_REGISTER:   disconf.SPAN_INIT_CONF,
+		disconf.SPAN_ZK_CREATE:  disconf.SPAN_REGISTER,
+		disconf.SPAN_ZK_VERSION: disconf.SPAN_REGISTER,
+		disconf.SPAN_ZK_SET:     disconf.SPAN_RELOAD,
+	} {
+		if parents[span] != parent {
+			t.Fatalf("unexpected parent [span:%v] [parent:%v] [want:%v]", span, parents[span], parent)
+		}
+	}
+}
+
+func TestNilOptions(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	conf := &Conf{}
+	defer newTestConf(t, server, conf, disconf.WithTracer(nil), disconf.WithMetrics(nil))()
+	if _, err := server.Watch().WaitApplied("a", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("a", server.UpdateItem("a", "2"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if conf.A != 2 {
+		t.Fatalf("unexpected conf [conf:%+v]", conf)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	client, cleanup := newTestClient(t, server, &Conf{})
+	defer cleanup()
+	if _, err := server.Watch().WaitApplied("a", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("a", server.UpdateItem("a", "x"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	status := client.Health()
+	if !status.Ready || !status.ZkConnected || !status.ServerReachable || status.Mode != disconf.MODE_REMOTE {
+		t.Fatalf("unexpected health [status:%+v]", status)
+	}
+	if !status.Degraded || status.Keys["a"].LastError == "" {
+		t.Fatalf("reload failure not reported [status:%+v]", status)
+	}
+	rec := httptest.NewRecorder()
+	client.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"ready":true`) {
+		t.Fatalf("unexpected readiness response [code:%v] [body:%v]", rec.Code, rec.Body.String())
+	}
+}
+
+// 获取配置列表前等待 release 关闭的 fetcher
+type blockingFetcher struct {
+	disconf.IFetcher
+	release chan struct{}
+}
+
+func (f blockingFetcher) GetAllConf(ctx context.Context, suffixUrl string) ([]*disconf.Result, []error) {
+	<-f.release
+	return f.IFetcher.GetAllConf(ctx, suffixUrl)
+}
+
+func TestHealthBeforeReady(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	health := disconf.NewHealth()
+	ready := func() (int, string) {
+		rec := httptest.NewRecorder()
+		health.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+		return rec.Code, rec.Body.String()
+	}
+	if code, body := ready(); code != http.StatusServiceUnavailable || !strings.Contains(body, `"ready":false`) {
+		t.Fatalf("unexpected readiness before NewClient [code:%v] [body:%v]", code, body)
+	}
+	fetcher, err := disconf.NewFetcher(server.URL, disconf.WithRetryTimes(0))
+	if err != nil {
+		t.Fatalf("new fetcher [err:%v]", err)
+	}
+	dir, err := ioutil.TempDir("", "disconf")
+	if err != nil {
+		t.Fatalf("temp dir [err:%v]", err)
+	}
+	defer os.RemoveAll(dir)
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := disconf.NewClient(server.URL, "disconf_demo", "1_0_0_0", "dev", true, false, &Conf{},
+			disconf.WithDownloadDir(dir+"/"), disconf.WithWatcher(server.Watch()), disconf.WithHealth(health),
+			disconf.WithFetcher(blockingFetcher{fetcher, release}))
+		done <- err
+	}()
+	// 初始加载阻塞在获取配置列表, 已经可以看到模式和 zk 状态
+	deadline := time.Now().Add(5 * time.Second)
+	for health.Status().Mode != disconf.MODE_REMOTE {
+		if time.Now().After(deadline) {
+			t.Fatalf("health not attached [status:%+v]", health.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code, body := ready(); code != http.StatusServiceUnavailable || !strings.Contains(body, `"ready":false`) {
+		t.Fatalf("unexpected readiness during init [code:%v] [body:%v]", code, body)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("new client [err:%v]", err)
+	}
+	if code, body := ready(); code != http.StatusOK || !strings.Contains(body, `"ready":true`) {
+		t.Fatalf("unexpected readiness after init [code:%v] [body:%v]", code, body)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\nmysql.password=123456\n"))
+	conf := &struct {
+		UserName string `conf:"mysql.username"`
+		Password string `conf:"mysql.password" secret:"true"`
+		A        int    `conf:"a"`
+		B        string `conf:"b"`
+	}{B: "fallback"}
+	client, cleanup := newTestClient(t, server, conf)
+	defer cleanup()
+	rec := httptest.NewRecorder()
+	client.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/config?format=json", nil))
+	var resp struct {
+		Entries []disconf.ConfigEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal [err:%v] [body:%v]", err, rec.Body.String())
+	}
+	entries := map[string]disconf.ConfigEntry{}
+	for _, e := range resp.Entries {
+		entries[e.Key] = e
+	}
+	if e := entries["mysql.password"]; e.Value != disconf.SECRET_MASK || e.Source != disconf.SOURCE_REMOTE_FILE || e.File != "jdbc.properties" {
+		t.Fatalf("unexpected secret entry [entry:%+v]", e)
+	}
+	if e := entries["a"]; e.Value != "1" || e.Source != disconf.SOURCE_REMOTE_ITEM {
+		t.Fatalf("unexpected item entry [entry:%+v]", e)
+	}
+	if e := entries["b"]; e.Value != "fallback" || e.Source != disconf.SOURCE_DEFAULT {
+		t.Fatalf("unexpected default entry [entry:%+v]", e)
+	}
+	rec = httptest.NewRecorder()
+	client.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/config", nil))
+	if strings.Contains(rec.Body.String(), "123456") {
+		t.Fatalf("secret leaked [body:%v]", rec.Body.String())
+	}
+}
+
+func TestSecretMasking(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("api.token", "tok-123")
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\nmysql.password=123456\n"))
+	dir, err := ioutil.TempDir("", "disconf")
+	if err != nil {
+		t.Fatalf("temp dir [err:%v]", err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &struct {
+		UserName string `conf:"mysql.username"`
+		Password string `conf:"mysql.password" secret:"true"`
+		Token    int    `conf:"api.token" auto:"true"`
+	}{}
+	_, err = disconf.NewClient(server.URL, "disconf_demo", "1_0_0_0", "dev", true, false, conf,
+		disconf.WithDownloadDir(dir+"/"), disconf.WithWatcher(server.Watch()), disconf.WithSecretKeys("*.TOKEN"))
+	if err == nil || strings.Contains(err.Error(), "tok-123") {
+		t.Fatalf("secret leaked in conversion error [err:%v]", err)
+	}
+	server.SetItem("api.token", "42")
+	if _, err = disconf.NewClient(server.URL, "disconf_demo", "1_0_0_0", "dev", true, false, conf,
+		disconf.WithDownloadDir(dir+"/"), disconf.WithWatcher(server.Watch()), disconf.WithSecretKeys("*.token")); err != nil {
+		t.Fatalf("new conf [err:%v]", err)
+	}
+	if content, _ := ioutil.ReadFile(dir + "/jdbc.properties"); strings.Contains(string(content), "123456") ||
+		!strings.Contains(string(content), "mysql.username=root") {
+		t.Fatalf("secret leaked to snapshot [content:%s]", content)
+	}
+	if conf.Password != "123456" || conf.Token != 42 {
+		t.Fatalf("secret not applied [conf:%+v]", conf)
+	}
+	if _, err := server.Watch().WaitApplied("jdbc.properties", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if value, _ := server.Watch().Value("jdbc.properties", disconf.DISCONF_TYPE_FILE); strings.Contains(string(value), "123456") {
+		t.Fatalf("secret leaked to zk [value:%s]", value)
+	}
+	if value, _ := server.Watch().Value("api.token", disconf.DISCONF_TYPE_ITEM); string(value) != disconf.SECRET_MASK {
+		t.Fatalf("secret leaked to zk [value:%s]", value)
+	}
+}
+
+func TestSecretSnapshotOnLoadError(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetFile("jdbc.properties", []byte("mysql.password=123456\na=x\n"))
+	dir, err := ioutil.TempDir("", "disconf")
+	if err != nil {
+		t.Fatalf("temp dir [err:%v]", err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &Conf{}
+	snapshot := func() string {
+		content, _ := ioutil.ReadFile(dir + "/jdbc.properties")
+		return string(content)
+	}
+	_, err = disconf.NewClient(server.URL, "disconf_demo", "1_0_0_0", "dev", true, false, conf,
+		disconf.WithDownloadDir(dir+"/"), disconf.WithWatcher(server.Watch()), disconf.WithSecretKeys("*.password"))
+	if err == nil {
+		t.Fatalf("conversion error not returned")
+	}
+	if content := snapshot(); strings.Contains(content, "123456") || !strings.Contains(content, "a=x") {
+		t.Fatalf("secret leaked to snapshot after failed load [content:%s]", content)
+	}
+	server.SetFile("jdbc.properties", []byte("mysql.password=123456\na=1\n"))
+	if _, err = disconf.NewClient(server.URL, "disconf_demo", "1_0_0_0", "dev", true, false, conf,
+		disconf.WithDownloadDir(dir+"/"), disconf.WithWatcher(server.Watch()), disconf.WithSecretKeys("*.password")); err != nil {
+		t.Fatalf("new conf [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("jdbc.properties", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	version := server.UpdateFile("jdbc.properties", []byte("mysql.password=654321\na=y\n"))
+	if keyStatus, err := server.Watch().WaitApplied("jdbc.properties", version, 5*time.Second); err != nil || keyStatus.Success {
+		t.Fatalf("reload should fail [status:%+v] [err:%v]", keyStatus, err)
+	}
+	if content := snapshot(); strings.Contains(content, "654321") || !strings.Contains(content, "a=y") {
+		t.Fatalf("secret leaked to snapshot after failed reload [content:%s]", content)
+	}
+}
+
+// 本地副本按解析规则掩码: BOM、utf-16、key 中含 : 以及以 \\ 结尾的值都不能泄露或丢失配置
+func TestSecretSnapshotEncoding(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	utf16, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String("db.password=654321\nb=1\n")
+	if err != nil {
+		t.Fatalf("encode utf-16 [err:%v]", err)
+	}
+	long := strings.Repeat("x", 100*1024)
+	server.SetFile("bom.properties", []byte("\xef\xbb\xbfmysql.password=123456\n"))
+	server.SetFile("utf16.properties", []byte(utf16))
+	server.SetFile("colon.properties", []byte("a:b.password=abcdef\n"))
+	server.SetFile("slash.properties", []byte("x.password=ab\\\nmysql.username=root\nlong="+long+"\n"))
+	dir, err := ioutil.TempDir("", "disconf")
+	if err != nil {
+		t.Fatalf("temp dir [err:%v]", err)
+	}
+	defer os.RemoveAll(dir)
+	client, err := disconf.NewClient(server.URL, "disconf_demo", "1_0_0_0", "dev", true, false, &Conf{},
+		disconf.WithDownloadDir(dir+"/"), disconf.WithWatcher(server.Watch()), disconf.WithSecretKeys("*.password"))
+	if err != nil {
 		t.Fatalf("new conf [err:%v]", err)
 	}
-	for {
-		fmt.Println("a", conf.Password)
-		fmt.Println(conf.TextGBK)
-		time.Sleep(5 * time.Second)
+	for fileName, secret := range map[string]string{
+		"bom.properties":   "123456",
+		"utf16.properties": "654321",
+		"colon.properties": "abcdef",
+		"slash.properties": "ab\\",
+	} {
+		content, _ := ioutil.ReadFile(dir + "/" + fileName)
+		if strings.Contains(string(content), secret) || !strings.Contains(string(content), "password="+disconf.SECRET_MASK) {
+			t.Fatalf("secret leaked to snapshot [fileName:%v] [content:%q]", fileName, content)
+		}
+	}
+	if content, _ := ioutil.ReadFile(dir + "/slash.properties"); !strings.Contains(string(content), "mysql.username=root") ||
+		!strings.Contains(string(content), "long="+long) {
+		t.Fatalf("key lost in snapshot [content:%.100q]", content)
+	}
+	if content, _ := ioutil.ReadFile(dir + "/utf16.properties"); !strings.Contains(string(content), "b=1") {
+		t.Fatalf("key lost in snapshot [content:%q]", content)
+	}
+	if value, _ := client.Get("a:b.password"); value != "abcdef" {
+		t.Fatalf("unexpected value [value:%v]", value)
+	}
+	if value, _ := client.Get("long"); value != long {
+		t.Fatalf("long line not loaded [len:%v]", len(value))
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	password, err := disconf.AesGcmEncrypt(key, "123456")
+	if err != nil {
+		t.Fatalf("encrypt [err:%v]", err)
+	}
+	port, err := disconf.AesGcmEncrypt(key, "3306")
+	if err != nil {
+		t.Fatalf("encrypt [err:%v]", err)
+	}
+	decrypter, err := disconf.NewAesGcmDecrypter(key)
+	if err != nil {
+		t.Fatalf("new decrypter [err:%v]", err)
+	}
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("mysql.port", strings.TrimSuffix(strings.TrimPrefix(port, "ENC("), ")"))
+	server.SetFile("jdbc.properties", []byte("mysql.password="+password+"\n"))
+	conf := &struct {
+		Password string `conf:"mysql.password" auto:"true"`
+		Port     int    `conf:"mysql.port" decrypt:"aes"`
+	}{}
+	client, cleanup := newTestClient(t, server, conf, disconf.WithDecrypter(disconf.DEFAULT_DECRYPTER, decrypter))
+	defer cleanup()
+	if conf.Password != "123456" || conf.Port != 3306 {
+		t.Fatalf("not decrypted [conf:%+v]", conf)
+	}
+	for _, e := range client.Entries() {
+		if !e.Secret || e.Value != disconf.SECRET_MASK {
+			t.Fatalf("decrypted value not masked [entry:%+v]", e)
+		}
+	}
+	if _, err := server.Watch().WaitApplied("jdbc.properties", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	password, _ = disconf.AesGcmEncrypt(key, "654321")
+	version := server.UpdateFile("jdbc.properties", []byte("mysql.password="+password+"\n"))
+	if _, err := server.Watch().WaitApplied("jdbc.properties", version, 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if conf.Password != "654321" {
+		t.Fatalf("not decrypted on reload [conf:%+v]", conf)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\nmysql.password=123456\n"))
+	os.Setenv("DISCONF_TEST_MYSQL_USERNAME", "env-user")
+	os.Setenv("DISCONF_TEST_A", "5")
+	os.Setenv("DISCONF_TEST_TEXTGBK", "env-only")
+	defer os.Unsetenv("DISCONF_TEST_MYSQL_USERNAME")
+	defer os.Unsetenv("DISCONF_TEST_A")
+	defer os.Unsetenv("DISCONF_TEST_TEXTGBK")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("a", "", "")
+	fs.String("mysql.password", "", "")
+	if err := fs.Parse([]string{"-a=7"}); err != nil {
+		t.Fatalf("parse flags [err:%v]", err)
+	}
+	conf := &Conf{}
+	client, cleanup := newTestClient(t, server, conf,
+		disconf.WithFlagOverrides(fs), disconf.WithEnvOverrides("DISCONF_TEST_"))
+	defer cleanup()
+	if conf.UserName != "env-user" || conf.A != 7 || conf.Password != "123456" || conf.TextGBK != "env-only" {
+		t.Fatalf("unexpected conf [conf:%+v]", conf)
+	}
+	sources := map[string]string{}
+	for _, e := range client.Entries() {
+		sources[e.Key] = e.Source + ":" + e.File
+	}
+	if sources["a"] != "flag:a" || sources["mysql.username"] != "env:DISCONF_TEST_MYSQL_USERNAME" ||
+		sources["mysql.password"] != "remoteFile:jdbc.properties" {
+		t.Fatalf("unexpected sources [sources:%v]", sources)
+	}
+	if _, err := server.Watch().WaitApplied("a", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("a", server.UpdateItem("a", "2"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if conf.A != 7 {
+		t.Fatalf("override lost on reload [conf:%+v]", conf)
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("db.host", "h1")
+	server.SetItem("a", "${DISCONF_TEST_UNSET_A:8}")
+	server.SetFile("jdbc.properties", []byte("mysql.username=${db.host}\nmysql.password=${db.host}:${db.port}\ndb.port=3306\n"))
+	conf := &Conf{}
+	defer newTestConf(t, server, conf)()
+	if conf.UserName != "h1" || conf.Password != "h1:3306" || conf.A != 8 {
+		t.Fatalf("unexpected conf [conf:%+v]", conf)
+	}
+	if _, err := server.Watch().WaitApplied("db.host", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("db.host", server.UpdateItem("db.host", "h2"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if conf.Password != "h2:3306" || conf.UserName != "h1" {
+		t.Fatalf("dependent key not reloaded [conf:%+v]", conf)
+	}
+}
+
+func TestPlaceholderCycle(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetFile("jdbc.properties", []byte("mysql.username=${mysql.password}\nmysql.password=${mysql.username}\n"))
+	dir, err := ioutil.TempDir("", "disconf")
+	if err != nil {
+		t.Fatalf("temp dir [err:%v]", err)
+	}
+	defer os.RemoveAll(dir)
+	err = disconf.NewConf(server.URL, "disconf_demo", "1_0_0_0", "dev", true, false, &Conf{},
+		disconf.WithDownloadDir(dir+"/"), disconf.WithRetryTimes(0), disconf.WithWatcher(server.Watch()))
+	if err == nil || !strings.Contains(err.Error(), "placeholder cycle") {
+		t.Fatalf("expected cycle error [err:%v]", err)
+	}
+}
+
+// 找不到的占位符默认原样保留, $${ 表示文本 ${
+func TestPlaceholderVerbatim(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("db.host", "h1")
+	server.SetItem("mysql.username", "hello ${DISCONF_TEST_UNSET_NAME} ${db.host")
+	server.SetItem("mysql.password", "$${db.host}-${db.host}")
+	conf := &Conf{}
+	defer newTestConf(t, server, conf)()
+	if conf.UserName != "hello ${DISCONF_TEST_UNSET_NAME} ${db.host" || conf.Password != "${db.host}-h1" {
+		t.Fatalf("unexpected conf [conf:%+v]", conf)
+	}
+	dir, err := ioutil.TempDir("", "disconf")
+	if err != nil {
+		t.Fatalf("temp dir [err:%v]", err)
+	}
+	defer os.RemoveAll(dir)
+	err = disconf.NewConf(server.URL, "disconf_demo", "1_0_0_0", "dev", true, false, &Conf{},
+		disconf.WithDownloadDir(dir+"/"), disconf.WithRetryTimes(0), disconf.WithWatcher(server.Watch()),
+		disconf.WithStrictPlaceholders())
+	if err == nil || !strings.Contains(err.Error(), "unresolved placeholder") {
+		t.Fatalf("expected unresolved placeholder error [err:%v]", err)
+	}
+}
+
+func TestEnvPlaceholders(t *testing.T) {
+	os.Setenv("DISCONF_TEST_PLACEHOLDER", "env")
+	defer os.Unsetenv("DISCONF_TEST_PLACEHOLDER")
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("mysql.username", "${DISCONF_TEST_PLACEHOLDER:def}")
+	conf := &Conf{}
+	defer newTestConf(t, server, conf)()
+	if conf.UserName != "def" {
+		t.Fatalf("env looked up without WithEnvPlaceholders [conf:%+v]", conf)
+	}
+	conf = &Conf{}
+	defer newTestConf(t, server, conf, disconf.WithEnvPlaceholders())()
+	if conf.UserName != "env" {
+		t.Fatalf("env not looked up [conf:%+v]", conf)
+	}
+}
+
+func TestPlaceholderSecret(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("mysql.username", "u:${db.pass}")
+	server.SetFile("jdbc.properties", []byte("db.pass=${mysql.password}\nmysql.password=123456\n"))
+	conf := &Conf{}
+	client, cleanup := newTestClient(t, server, conf, disconf.WithSecretKeys("*.password"))
+	defer cleanup()
+	if conf.UserName != "u:123456" {
+		t.Fatalf("unexpected conf [conf:%+v]", conf)
+	}
+	for _, e := range client.Entries() {
+		if e.Key == "mysql.username" && (!e.Secret || e.Value != disconf.SECRET_MASK) {
+			t.Fatalf("value resolved from secret not masked [entry:%+v]", e)
+		}
+	}
+	if _, err := server.Watch().WaitApplied("mysql.username", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if value, _ := server.Watch().Value("mysql.username", disconf.DISCONF_TYPE_ITEM); string(value) != disconf.SECRET_MASK {
+		t.Fatalf("value resolved from secret not masked in zk [value:%s]", value)
+	}
+}
+
+func TestCharset(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	gbk, err := simplifiedchinese.GBK.NewEncoder().String("textGBK=中文配置\n")
+	if err != nil {
+		t.Fatalf("encode gbk [err:%v]", err)
+	}
+	server.SetFile("text.properties", []byte(gbk))
+	server.SetFile("jdbc.properties", []byte("mysql.username=caf\xe9 \\u4e2d\\u6587 \\ud83d\\ude00\n"))
+	server.SetFile("bom.properties", []byte("\xef\xbb\xbfmysql.password=123456\n"))
+	// 转义出的 = : 和换行属于 key 或 value, 不参与拆分
+	server.SetFile("escaped.properties", []byte("a\\u003db=x\\u003ay\\u000az\n"))
+	conf := &Conf{}
+	client, cleanup := newTestClient(t, server, conf,
+		disconf.WithCharset(disconf.CHARSET_ISO_8859_1), disconf.WithFileCharset("text.properties", disconf.CHARSET_GBK))
+	defer cleanup()
+	if conf.TextGBK != "中文配置" || conf.UserName != "café 中文 😀" || conf.Password != "123456" {
+		t.Fatalf("unexpected conf [conf:%+v]", conf)
+	}
+	if value, ok := client.Get("a=b"); !ok || value != "x:y\nz" {
+		t.Fatalf("escaped separator split the line [value:%q]", value)
+	}
+	if _, ok := client.Get("a"); ok {
+		t.Fatalf("escaped separator split the line")
+	}
+	if _, err := server.Watch().WaitApplied("text.properties", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	gbk, _ = simplifiedchinese.GBK.NewEncoder().String("textGBK=热加载\n")
+	if _, err := server.Watch().WaitApplied("text.properties", server.UpdateFile("text.properties", []byte(gbk)), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if conf.TextGBK != "热加载" {
+		t.Fatalf("unexpected conf after reload [conf:%+v]", conf)
+	}
+}
+
+func TestUnknownCharset(t *testing.T) {
+	err := disconf.NewConf("http://127.0.0.1:0", "disconf_demo", "1_0_0_0", "dev", false, false, &Conf{},
+		disconf.WithCharset("ebcdic"))
+	if err == nil || !strings.Contains(err.Error(), "unknown charset") {
+		t.Fatalf("expected unknown charset error [err:%v]", err)
+	}
+}
+
+// go test -race 时检查 Bind 与热加载中的掩码并发
+func TestBindDuringReload(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\nmysql.password=123456\n"))
+	client, cleanup := newTestClient(t, server, &Conf{})
+	defer cleanup()
+	if _, err := server.Watch().WaitApplied("jdbc.properties", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			db := &struct {
+				Password string `conf:"password" secret:"true"`
+			}{}
+			if err := client.Bind(db, disconf.WithBindPrefix("mysql.")); err != nil {
+				t.Errorf("bind [err:%v]", err)
+				return
+			}
+		}
+	}()
+	var version int32
+	for i := 0; i < 5; i++ {
+		version = server.UpdateFile("jdbc.properties", []byte(fmt.Sprintf("mysql.username=root\nmysql.password=%d\n", i)))
+	}
+	<-done
+	if _, err := server.Watch().WaitApplied("jdbc.properties", version, 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+}
+
+func TestBind(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\nmysql.password=123456\n"))
+	server.SetFile("other.properties", []byte("a=2\n"))
+	conf := &Conf{}
+	client, cleanup := newTestClient(t, server, conf, disconf.WithIgnore("other.properties"))
+	defer cleanup()
+	db := &struct {
+		UserName string `conf:"username"`
+		Password string `conf:"password" auto:"true"`
+	}{}
+	if err := client.Bind(db, disconf.WithBindPrefix("mysql.")); err != nil {
+		t.Fatalf("bind [err:%v]", err)
+	}
+	if db.UserName != "root" || db.Password != "123456" {
+		t.Fatalf("unexpected bound conf [conf:%+v]", db)
+	}
+	jdbc := &struct {
+		A int `conf:"a" auto:"true"`
+	}{A: 9}
+	if err := client.Bind(jdbc, disconf.WithBindFile("jdbc.properties")); err != nil {
+		t.Fatalf("bind [err:%v]", err)
+	}
+	if jdbc.A != 9 || conf.A != 1 {
+		t.Fatalf("file scoped bind got item value [conf:%+v] [jdbc:%+v]", conf, jdbc)
+	}
+	if err := client.Bind(*db); err == nil {
+		t.Fatalf("expected error binding non pointer")
+	}
+	if _, err := server.Watch().WaitApplied("jdbc.properties", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	version := server.UpdateFile("jdbc.properties", []byte("mysql.username=root\nmysql.password=654321\na=3\n"))
+	if _, err := server.Watch().WaitApplied("jdbc.properties", version, 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if db.Password != "654321" || conf.Password != "654321" || jdbc.A != 3 {
+		t.Fatalf("bound conf not reloaded [conf:%+v] [db:%+v] [jdbc:%+v]", conf, db, jdbc)
+	}
+	targets := map[string]bool{}
+	for _, e := range client.Entries() {
+		if e.Key == "mysql.password" {
+			targets[e.Target] = true
+		}
+	}
+	if len(targets) != 2 {
+		t.Fatalf("unexpected entries [targets:%v]", targets)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\n"))
+	common := server.App("common", "1_0_0_0", "dev")
+	common.SetItem("a", "100")
+	common.SetFile("jdbc.properties", []byte("mysql.username=common\nmysql.password=common-pw\n"))
+	common.SetFile("common.properties", []byte("textGBK=common\n"))
+	conf := &Conf{}
+	client, cleanup := newTestClient(t, server, conf, disconf.WithSubscription("common", "1_0_0_0", "dev"))
+	defer cleanup()
+	if conf.A != 1 || conf.UserName != "root" || conf.Password != "common-pw" || conf.TextGBK != "common" {
+		t.Fatalf("unexpected conf [conf:%+v]", conf)
+	}
+	for _, e := range client.Entries() {
+		if e.Key == "textGBK" && e.Subscription != "common_1_0_0_0_dev" {
+			t.Fatalf("unexpected entry [entry:%+v]", e)
+		}
+		if e.Key == "a" && e.Subscription != disconf.EMPTY_STRING {
+			t.Fatalf("unexpected entry [entry:%+v]", e)
+		}
+	}
+	if _, err := common.Watch().WaitApplied("a", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if _, err := common.Watch().WaitApplied("a", common.UpdateItem("a", "200"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	version := common.UpdateFile("common.properties", []byte("textGBK=reloaded\n"))
+	if _, err := common.Watch().WaitApplied("common.properties", version, 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if conf.A != 1 || conf.TextGBK != "reloaded" {
+		t.Fatalf("unexpected conf after reload [conf:%+v]", conf)
+	}
+	if _, err := server.Watch().WaitApplied("a", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("a", server.UpdateItem("a", "2"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if conf.A != 2 {
+		t.Fatalf("unexpected conf after reload [conf:%+v]", conf)
+	}
+}
+
+func TestView(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	server.SetItem("tenant.t1.timeout", "3s")
+	server.SetItem("broken", "${DISCONF_TEST_UNSET_BROKEN}")
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\nmysql.port=3306\nmysql.enabled=true\nmysql.hosts=h1, h2\nmysql.dsn=${mysql.username}@${mysql.port}\n"))
+	client, cleanup := newTestClient(t, server, nil, disconf.WithStrictPlaceholders())
+	defer cleanup()
+	if v, ok := client.Get("mysql.dsn"); !ok || v != "root@3306" {
+		t.Fatalf("unexpected value [value:%v] [ok:%v]", v, ok)
+	}
+	if _, ok := client.Get("missing"); ok {
+		t.Fatalf("unexpected missing key")
+	}
+	if _, ok := client.Get("broken"); ok {
+		t.Fatalf("unresolved placeholder returned")
+	}
+	if _, err := disconf.Get[string](client, "broken"); err == nil || !strings.Contains(err.Error(), "unresolved placeholder") {
+		t.Fatalf("expected placeholder error [err:%v]", err)
+	}
+	if _, err := disconf.Get[any](client, "a"); err == nil {
+		t.Fatalf("expected unknown type error")
+	}
+	if err := client.Bind(&struct {
+		A disconf.Value[any] `conf:"a"`
+	}{}); err == nil {
+		t.Fatalf("expected unknown type error")
+	}
+	if v, err := client.GetInt("a"); err != nil || v != 1 {
+		t.Fatalf("get int [value:%v] [err:%v]", v, err)
+	}
+	if v, err := client.GetDuration("tenant.t1.timeout"); err != nil || v != 3*time.Second {
+		t.Fatalf("get duration [value:%v] [err:%v]", v, err)
+	}
+	if _, err := client.GetBool("mysql.username"); err == nil {
+		t.Fatalf("expected conversion error")
+	}
+	mysql := client.Sub("mysql.")
+	if v, err := disconf.Get[bool](mysql, "enabled"); err != nil || !v {
+		t.Fatalf("get bool [value:%v] [err:%v]", v, err)
+	}
+	if v, err := disconf.Get[[]string](mysql, "hosts"); err != nil || len(v) != 2 || v[1] != "h2" {
+		t.Fatalf("get slice [value:%v] [err:%v]", v, err)
+	}
+	if keys := mysql.Keys(""); strings.Join(keys, ",") != "dsn,enabled,hosts,port,username" {
+		t.Fatalf("unexpected keys [keys:%v]", keys)
+	}
+	if all := client.Sub("tenant.").All(); len(all) != 1 || all["t1.timeout"] != "3s" {
+		t.Fatalf("unexpected all [all:%v]", all)
+	}
+	if _, err := server.Watch().WaitApplied("jdbc.properties", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	version := server.UpdateFile("jdbc.properties", []byte("mysql.username=admin\nmysql.port=3307\n"))
+	if _, err := server.Watch().WaitApplied("jdbc.properties", version, 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if v, _ := mysql.Get("username"); v != "admin" {
+		t.Fatalf("view not reloaded [value:%v]", v)
+	}
+	if v, ok := mysql.Get("dsn"); ok {
+		t.Fatalf("removed key still visible [value:%v]", v)
+	}
+	if keys := mysql.Keys(""); strings.Join(keys, ",") != "port,username" {
+		t.Fatalf("removed keys still listed [keys:%v]", keys)
+	}
+}
+
+func TestDynamicValues(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	server.SetItem("timeout", "2s")
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\n"))
+	conf := &struct {
+		UserName disconf.String        `conf:"mysql.username"`
+		A        *disconf.Int64        `conf:"a"`
+		Timeout  disconf.Duration      `conf:"timeout"`
+		Missing  disconf.Value[string] `conf:"missing"`
+	}{}
+	conf.Missing.Store("default")
+	client, cleanup := newTestClient(t, server, conf)
+	defer cleanup()
+	if conf.UserName.Load() != "root" || conf.A.Load() != 1 || conf.Timeout.Load() != 2*time.Second || conf.Missing.Load() != "default" {
+		t.Fatalf("unexpected conf [conf:%+v]", conf)
+	}
+	changed := make(chan string, 1)
+	cancel := conf.A.OnChange(func(old, new int64) {
+		// 回调中读取配置不会死锁
+		value, _ := client.Get("a")
+		changed <- fmt.Sprintf("%v->%v:%v", old, new, value)
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			conf.A.Load()
+		}
+	}()
+	if _, err := server.Watch().WaitApplied("a", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("a", server.UpdateItem("a", "2"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	<-done
+	if got := <-changed; got != "1->2:2" {
+		t.Fatalf("unexpected change [change:%v]", got)
+	}
+	cancel()
+	if _, err := server.Watch().WaitApplied("a", server.UpdateItem("a", "3"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if conf.A.Load() != 3 || len(changed) != 0 {
+		t.Fatalf("unexpected conf after cancel [a:%v]", conf.A.Load())
+	}
+	for _, e := range client.Entries() {
+		if e.Key == "a" && (e.Value != "3" || !e.Auto) {
+			t.Fatalf("unexpected entry [entry:%+v]", e)
+		}
+	}
+}
+
+func TestDynamicMissingKey(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\n"))
+	conf := &struct {
+		Port *disconf.Int64 `conf:"mysql.port"`
+	}{}
+	client, cleanup := newTestClient(t, server, conf)
+	defer cleanup()
+	port := conf.Port
+	if port == nil || port.Load() != 0 {
+		t.Fatalf("missing dynamic field not allocated [conf:%+v]", conf)
+	}
+	bound := &struct {
+		Timeout *disconf.Duration `conf:"timeout"`
+	}{}
+	if err := client.Bind(bound); err != nil || bound.Timeout == nil {
+		t.Fatalf("missing dynamic field not allocated on bind [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("jdbc.properties", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	version := server.UpdateFile("jdbc.properties", []byte("mysql.username=root\nmysql.port=3306\n"))
+	if _, err := server.Watch().WaitApplied("jdbc.properties", version, 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if conf.Port != port || port.Load() != 3306 {
+		t.Fatalf("dynamic field replaced on reload [port:%v]", conf.Port.Load())
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("feature.on", "on")
+	server.SetItem("feature.half", "50%")
+	server.SetItem("feature.beta", `{"percentage": 0, "users": ["u1"]}`)
+	server.SetItem("feature.canary", `{"instances": ["i-*"], "ips": ["192.168.0.0/16"]}`)
+	server.SetItem("feature.other", `{"ips": ["192.168.0.0/16"]}`)
+	server.SetItem("feature.users", `{"users": ["u1"]}`)
+	server.SetItem("feature.mixed", `{"percentage": 100, "ips": ["192.168.0.0/16"]}`)
+	server.SetItem("feature.bad", "maybe")
+	client, cleanup := newTestClient(t, server, nil, disconf.WithHost("10.1.2.3"), disconf.WithInstanceId("i-1"))
+	defer cleanup()
+	fc := disconf.FlagContext{UserId: "u1"}
+	if !client.Enabled("feature.on", fc) || client.Enabled("feature.missing", fc) || client.Enabled("feature.bad", fc) {
+		t.Fatalf("unexpected on/missing/bad flags")
+	}
+	if !client.Enabled("feature.beta", fc) || client.Enabled("feature.beta", disconf.FlagContext{UserId: "u2"}) {
+		t.Fatalf("unexpected allowlist flag")
+	}
+	if !client.Enabled("feature.users", fc) || client.Enabled("feature.users", disconf.FlagContext{UserId: "u2"}) ||
+		client.Enabled("feature.users", disconf.FlagContext{}) {
+		t.Fatalf("allowlist only flag enabled for other users")
+	}
+	if !client.Enabled("feature.mixed", disconf.FlagContext{UserId: "u2"}) {
+		t.Fatalf("explicit percentage ignored with allowlist")
+	}
+	if !client.Enabled("feature.canary", fc) || client.Enabled("feature.other", fc) {
+		t.Fatalf("unexpected instance targeting")
+	}
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		user := disconf.FlagContext{UserId: fmt.Sprintf("user-%v", i)}
+		on := client.Enabled("feature.half", user)
+		if on != client.Enabled("feature.half", user) {
+			t.Fatalf("unstable rollout [user:%v]", user.UserId)
+		}
+		if on {
+			enabled++
+		}
+	}
+	if enabled < 400 || enabled > 600 {
+		t.Fatalf("unexpected rollout [enabled:%v]", enabled)
+	}
+	if _, err := server.Watch().WaitApplied("feature.on", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if _, err := server.Watch().WaitApplied("feature.on", server.UpdateItem("feature.on", "off"), 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if client.Enabled("feature.on", fc) {
+		t.Fatalf("flag not reloaded")
+	}
+}
+
+func TestCanary(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("timeout", "1s")
+	server.SetItem("retry", "3")
+	server.SetItem("disconf.canary", `[{"name": "zone-a", "labels": {"zone": "a"}, "values": {"timeout": "3s"}},
+		{"name": "other", "ips": ["192.168.0.0/16"], "values": {"retry": "5"}},
+		{"name": "db", "percentage": 100, "file": "db.canary.properties"}]`)
+	server.SetFile("db.properties", []byte("db.url=base\n"))
+	server.SetFile("db.canary.properties", []byte("db.url=canary\n"))
+	conf := &struct {
+		Timeout disconf.Duration `conf:"timeout"`
+		Retry   int              `conf:"retry" auto:"true"`
+		DbUrl   string           `conf:"db.url"`
+	}{}
+	client, cleanup := newTestClient(t, server, conf, disconf.WithHost("10.1.2.3"),
+		disconf.WithInstanceMetadata(map[string]string{"zone": "a"}), disconf.WithCanary("disconf.canary"))
+	defer cleanup()
+	if conf.Timeout.Load() != 3*time.Second || conf.Retry != 3 || conf.DbUrl != "canary" {
+		t.Fatalf("unexpected conf [timeout:%v] [retry:%v] [db.url:%v]", conf.Timeout.Load(), conf.Retry, conf.DbUrl)
+	}
+	for _, e := range client.Entries() {
+		if e.Key == "timeout" && (e.Source != disconf.SOURCE_CANARY || e.File != "zone-a") {
+			t.Fatalf("unexpected entry [entry:%+v]", e)
+		}
+	}
+	if _, err := server.Watch().WaitApplied("disconf.canary", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	status, err := server.Watch().InstanceStatus()
+	if err != nil {
+		t.Fatalf("instance status [err:%v]", err)
+	}
+	if status.Canary["timeout"] != "zone-a" || status.Canary["db.url"] != "db" || len(status.Canary) != 2 {
+		t.Fatalf("unexpected canary status [canary:%v]", status.Canary)
+	}
+	version := server.UpdateItem("disconf.canary", `[{"name": "all", "values": {"retry": "4"}}]`)
+	if _, err := server.Watch().WaitApplied("disconf.canary", version, 5*time.Second); err != nil {
+		t.Fatalf("wait applied [err:%v]", err)
+	}
+	if conf.Timeout.Load() != time.Second || conf.Retry != 4 {
+		t.Fatalf("unexpected conf after update [timeout:%v] [retry:%v]", conf.Timeout.Load(), conf.Retry)
+	}
+	if value, _ := client.Get("db.url"); value != "base" {
+		t.Fatalf("unexpected db.url [value:%v]", value)
+	}
+	if status, err = server.Watch().InstanceStatus(); err != nil || status.Canary["retry"] != "all" || len(status.Canary) != 1 {
+		t.Fatalf("unexpected canary status [canary:%v] [err:%v]", status.Canary, err)
+	}
+}
+
+func TestCanarySecret(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("disconf.canary", `[{"name": "all", "values": {"mysql.password": "654321", "timeout": "3s"}}]`)
+	conf := &struct {
+		Password string `conf:"mysql.password"`
+		Rules    string `conf:"disconf.canary"`
+	}{}
+	client, cleanup := newTestClient(t, server, conf, disconf.WithCanary("disconf.canary"), disconf.WithSecretKeys("*.password"))
+	defer cleanup()
+	if conf.Password != "654321" {
+		t.Fatalf("canary value not applied [conf:%+v]", conf)
+	}
+	for _, e := range client.Entries() {
+		if e.Key == "disconf.canary" && (strings.Contains(e.Value, "654321") || !strings.Contains(e.Value, "3s")) {
+			t.Fatalf("canary secret not masked in entries [entry:%+v]", e)
+		}
+	}
+	if _, err := server.Watch().WaitApplied("disconf.canary", 0, 5*time.Second); err != nil {
+		t.Fatalf("wait registered [err:%v]", err)
+	}
+	if value, _ := server.Watch().Value("disconf.canary", disconf.DISCONF_TYPE_ITEM); strings.Contains(string(value), "654321") ||
+		!strings.Contains(string(value), "3s") {
+		t.Fatalf("canary secret not masked in zk [value:%s]", value)
+	}
+}
+
+// 同一个 Fetcher 的请求复用 http 连接
+func TestFetcherKeepAlive(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetItem("a", "1")
+	target, _ := url.Parse(server.URL)
+	var mutex sync.Mutex
+	conns := 0
+	host := httptest.NewUnstartedServer(httputil.NewSingleHostReverseProxy(target))
+	host.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mutex.Lock()
+			conns++
+			mutex.Unlock()
+		}
+	}
+	host.Start()
+	defer host.Close()
+	fetcher, err := disconf.NewFetcher(host.URL, disconf.WithRetryTimes(0))
+	if err != nil {
+		t.Fatalf("new fetcher [err:%v]", err)
+	}
+	for i := 0; i < 5; i++ {
+		if value, errs := fetcher.GetValue(context.Background(), "?app=disconf_demo&env=dev&version=1_0_0_0&key=a"); len(errs) > 0 || value != "1" {
+			t.Fatalf("get value [value:%v] [errs:%v]", value, errs)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if conns != 1 {
+		t.Fatalf("connection not reused [conns:%v]", conns)
+	}
+}
+
+// 第一个 host 执行写操作后返回 500 时不重试也不换 host, 连接失败时才换 host
+func TestAdminWriteFailover(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetAdmin("admin", "secret")
+	server.App("demo", "1_0_0_0", "prod").SetItem("timeout", "3s")
+	target, _ := url.Parse(server.URL)
+	var mutex sync.Mutex
+	writes := map[string]int{}
+	newHost := func(name string, fail bool) *httptest.Server {
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if fail && resp.Request.Method != http.MethodGet && resp.Request.URL.Path != disconf.DISCONF_SIGNIN_ACTION {
+				resp.StatusCode = http.StatusInternalServerError
+			}
+			return nil
+		}
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.URL.Path != disconf.DISCONF_SIGNIN_ACTION {
+				mutex.Lock()
+				writes[name]++
+				mutex.Unlock()
+			}
+			proxy.ServeHTTP(w, r)
+		}))
+	}
+	count := func() map[string]int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return map[string]int{"failing": writes["failing"], "ok": writes["ok"]}
+	}
+	failing, ok := newHost("failing", true), newHost("ok", false)
+	defer failing.Close()
+	defer ok.Close()
+	ctx := context.Background()
+	fetcher, err := disconf.NewFetcher(failing.URL+","+ok.URL, disconf.WithRetryTimes(2), disconf.WithRetrySleepSeconds(0))
+	if err != nil {
+		t.Fatalf("new fetcher [err:%v]", err)
+	}
+	admin, _ := disconf.NewAdmin(fetcher, "admin", "secret")
+	if _, err := admin.SetItem(ctx, "demo", "1_0_0_0", "prod", "retry", "3"); err == nil {
+		t.Fatalf("expected error from failing host")
+	}
+	if w := count(); w["failing"] != 1 || w["ok"] != 0 {
+		t.Fatalf("write repeated [writes:%v]", w)
+	}
+	if value, errs := fetcher.GetValue(ctx, "?app=demo&env=prod&version=1_0_0_0&key=retry"); len(errs) > 0 || value != "3" {
+		t.Fatalf("write not committed [value:%v] [errs:%v]", value, errs)
+	}
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	fetcher, err = disconf.NewFetcher(closed.URL+","+ok.URL, disconf.WithRetryTimes(0))
+	if err != nil {
+		t.Fatalf("new fetcher [err:%v]", err)
+	}
+	admin, _ = disconf.NewAdmin(fetcher, "admin", "secret")
+	if _, err := admin.SetItem(ctx, "demo", "1_0_0_0", "prod", "timeout", "5s"); err != nil || count()["ok"] != 1 {
+		t.Fatalf("write not failed over on connection error [writes:%v] [err:%v]", count(), err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	server := disconftest.NewServer()
+	defer server.Close()
+	server.SetAdmin("admin", "secret")
+	prod := server.App("demo", "1_0_0_0", "prod")
+	prod.SetItem("timeout", "3s")
+	fetcher, err := disconf.NewFetcher(server.URL, disconf.WithRetryTimes(0))
+	if err != nil {
+		t.Fatalf("new fetcher [err:%v]", err)
+	}
+	ctx := context.Background()
+	wrong, _ := disconf.NewAdmin(fetcher, "admin", "wrong")
+	if err := wrong.Login(ctx); err == nil {
+		t.Fatalf("login with wrong password")
+	}
+	dryRun, _ := disconf.NewAdmin(fetcher, "admin", "wrong", disconf.WithDryRun())
+	if act, err := dryRun.SetItem(ctx, "demo", "1_0_0_0", "prod", "timeout", "5s"); err != nil || !act.DryRun ||
+		act.String() != "PUT /api/web/config/item/1 value=5s" {
+		t.Fatalf("unexpected dry run [action:%v] [err:%v]", act, err)
+	}
+	masked, _ := disconf.NewAdmin(fetcher, "admin", "wrong", disconf.WithDryRun(), disconf.WithAdminSecretKeys("*.password"))
+	if act, err := masked.SetItem(ctx, "demo", "1_0_0_0", "prod", "db.password", "123456"); err != nil ||
+		strings.Contains(act.String(), "123456") || !strings.Contains(act.String(), "value="+disconf.SECRET_MASK) {
+		t.Fatalf("secret leaked in dry run [action:%v] [err:%v]", act, err)
+	}
+	admin, _ := disconf.NewAdmin(fetcher, "admin", "secret")
+	if act, err := admin.SetItem(ctx, "demo", "1_0_0_0", "prod", "timeout", "3s"); err != nil || act != nil {
+		t.Fatalf("unexpected unchanged item [action:%v] [err:%v]", act, err)
+	}
+	if _, err := admin.SetItem(ctx, "demo", "1_0_0_0", "prod", "timeout", "5s"); err != nil {
+		t.Fatalf("update item [err:%v]", err)
+	}
+	if _, err := admin.SetItem(ctx, "demo", "1_0_0_0", "prod", "retry", "3"); err != nil {
+		t.Fatalf("create item [err:%v]", err)
+	}
+	if _, err := admin.SetFile(ctx, "demo", "1_0_0_0", "prod", "jdbc.properties", []byte("mysql.username=root\n")); err != nil {
+		t.Fatalf("create file [err:%v]", err)
+	}
+	if _, err := admin.SetItem(ctx, "demo", "1_0_0_0", "test", "timeout", "5s"); err == nil {
+		t.Fatalf("create item in unknown env")
+	}
+	remote, err := fetcher.FetchAll(ctx, "demo", "1_0_0_0", "prod")
+	if err != nil {
+		t.Fatalf("fetch all [err:%v]", err)
+	}
+	if remote.Items["timeout"] != "5s" || remote.Items["retry"] != "3" || remote.Files["jdbc.properties"]["mysql.username"] != "root" {
+		t.Fatalf("unexpected remote config [items:%v] [files:%v]", remote.Items, remote.Files)
+	}
+	if act, err := admin.Delete(ctx, "demo", "1_0_0_0", "prod", "retry", disconf.DISCONF_TYPE_ITEM); err != nil || act == nil {
+		t.Fatalf("delete item [action:%v] [err:%v]", act, err)
+	}
+	if value, errs := fetcher.GetValue(ctx, "?app=demo&env=prod&version=1_0_0_0&key=retry"); len(errs) == 0 {
+		t.Fatalf("item not deleted [value:%v]", value)
+	}
+	watch := prod.Watch()
+	// 更新配置项时服务端通知客户端
+	if version, _ := watch.GetZkVersion("/disconf/demo_1_0_0_0_prod/item/timeout"); version != 1 {
+		t.Fatalf("update not notified [version:%v]", version)
+	}
+	if _, err := admin.Notify(watch, "timeout", disconf.DISCONF_TYPE_ITEM, []byte("5s")); err != nil {
+		t.Fatalf("notify [err:%v]", err)
+	}
+	if paths := watch.Paths("/disconf/demo_1_0_0_0_prod/item/timeout"); len(paths) != 1 {
+		t.Fatalf("unexpected zk paths [paths:%v]", paths)
 	}
 }
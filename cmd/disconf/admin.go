@@ -0,0 +1,168 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+)
+
+const (
+	// 默认的管理接口用户和密码, 避免密码出现在命令行历史中
+	ENV_USER     = "DISCONF_USER"
+	ENV_PASSWORD = "DISCONF_PASSWORD"
+)
+
+// 写操作的公共参数
+type adminFlags struct {
+	fs     *flag.FlagSet
+	dryRun *bool
+	file   *bool
+}
+
+func (c *cli) adminFlags(name string, file bool) *adminFlags {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	f := &adminFlags{fs: fs, dryRun: fs.Bool("dry-run", false, "只打印将要执行的操作")}
+	if file {
+		f.file = fs.Bool("file", false, "操作配置文件, 默认为配置项")
+	}
+	return f
+}
+
+func (f *adminFlags) disconfType() int {
+	if f.file != nil && *f.file {
+		return disconf.DISCONF_TYPE_FILE
+	}
+	return disconf.DISCONF_TYPE_ITEM
+}
+
+func (c *cli) admin(dryRun bool) (*disconf.Admin, *disconf.Fetcher, error) {
+	fetcher, err := c.fetcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := []disconf.AdminOption{disconf.WithAdminSecretKeys(c.secretKeys...)}
+	if dryRun {
+		opts = append(opts, disconf.WithDryRun())
+	} else if c.user == disconf.EMPTY_STRING {
+		return nil, nil, fmt.Errorf("-user or %v is required", ENV_USER)
+	}
+	admin, err := disconf.NewAdmin(fetcher, c.user, c.password, opts...)
+	return admin, fetcher, err
+}
+
+func (c *cli) printAction(act *disconf.AdminAction, err error) error {
+	if err != nil {
+		return err
+	}
+	switch {
+	case act == nil:
+		fmt.Fprintln(c.stdout, "unchanged")
+	case act.DryRun:
+		fmt.Fprintf(c.stdout, "dry run: %v\n", act)
+	default:
+		fmt.Fprintln(c.stdout, act)
+	}
+	return nil
+}
+
+func (c *cli) setItem(args []string) error {
+	f := c.adminFlags("set-item", false)
+	if err := f.fs.Parse(args); err != nil {
+		return err
+	}
+	if f.fs.NArg() != 2 {
+		return fmt.Errorf("usage: set-item [-dry-run] <key> <value>")
+	}
+	admin, _, err := c.admin(*f.dryRun)
+	if err != nil {
+		return err
+	}
+	return c.printAction(admin.SetItem(context.Background(), c.app, c.version, c.env, f.fs.Arg(0), f.fs.Arg(1)))
+}
+
+func (c *cli) setFile(args []string) error {
+	f := c.adminFlags("set-file", false)
+	name := f.fs.String("name", disconf.EMPTY_STRING, "配置文件名, 默认为本地文件名")
+	if err := f.fs.Parse(args); err != nil {
+		return err
+	}
+	if f.fs.NArg() != 1 {
+		return fmt.Errorf("usage: set-file [-dry-run] [-name n] <path>")
+	}
+	content, err := ioutil.ReadFile(f.fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *name == disconf.EMPTY_STRING {
+		*name = filepath.Base(f.fs.Arg(0))
+	}
+	admin, _, err := c.admin(*f.dryRun)
+	if err != nil {
+		return err
+	}
+	return c.printAction(admin.SetFile(context.Background(), c.app, c.version, c.env, *name, content))
+}
+
+func (c *cli) delete(args []string) error {
+	f := c.adminFlags("delete", true)
+	if err := f.fs.Parse(args); err != nil {
+		return err
+	}
+	if f.fs.NArg() != 1 {
+		return fmt.Errorf("usage: delete [-dry-run] [-file] <name>")
+	}
+	admin, _, err := c.admin(*f.dryRun)
+	if err != nil {
+		return err
+	}
+	act, err := admin.Delete(context.Background(), c.app, c.version, c.env, f.fs.Arg(0), f.disconfType())
+	if err == nil && act == nil {
+		return fmt.Errorf("config not found [name:%v]", f.fs.Arg(0))
+	}
+	return c.printAction(act, err)
+}
+
+// 把服务端当前的值写入 zk 节点, 通知所有客户端重新加载
+func (c *cli) notify(args []string) error {
+	f := c.adminFlags("notify", true)
+	if err := f.fs.Parse(args); err != nil {
+		return err
+	}
+	if f.fs.NArg() != 1 {
+		return fmt.Errorf("usage: notify [-dry-run] [-file] <name>")
+	}
+	name := f.fs.Arg(0)
+	admin, fetcher, err := c.admin(*f.dryRun)
+	if err != nil {
+		return err
+	}
+	var value []byte
+	var errs []error
+	if f.disconfType() == disconf.DISCONF_TYPE_FILE {
+		value, errs = fetcher.GetFile(context.Background(), c.suffixUrl(name))
+	} else {
+		var item string
+		item, errs = fetcher.GetValue(context.Background(), c.suffixUrl(name))
+		value = []byte(item)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("get current value [name:%v] [errs:%v]", name, errs)
+	}
+	watch, err := dialWatch(fetcher, c.app, c.version, c.env, c.options()...)
+	if err != nil {
+		return err
+	}
+	defer watch.Close()
+	return c.printAction(admin.Notify(watch, name, f.disconfType(), value))
+}
@@ -0,0 +1,209 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+)
+
+const (
+	CHANGE_ADDED   = "+"
+	CHANGE_REMOVED = "-"
+	CHANGE_CHANGED = "~"
+	// diff 有差异时的退出码, 与出错 (EXIT_ERR) 和参数错误 (EXIT_USAGE) 区分
+	EXIT_DIFF = 3
+)
+
+// 有差异时返回, run 按 EXIT_DIFF 退出
+var errDiff = fmt.Errorf("configs differ")
+
+// 一个配置项、配置文件或配置文件中的 key 的差异, file 为空时是配置项
+type change struct {
+	kind string
+	file string
+	key  string
+	from string
+	to   string
+}
+
+// 可以重复的 flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, disconf.COMMA_SPLIT)
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// 比较两组 app/version/env 的配置, 对方的参数默认与 -host、-app、-version、-env 相同:
+//
+//	disconf -app demo -version 1_0_0_0 -env dev diff -to-env prod -ignore 'local.*'
+func (c *cli) diff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	toHost := fs.String("to-host", c.host, "对方的服务端地址")
+	toApp := fs.String("to-app", c.app, "对方的 app")
+	toVersion := fs.String("to-version", c.version, "对方的 version")
+	toEnv := fs.String("to-env", c.env, "对方的 env")
+	var ignore stringList
+	fs.Var(&ignore, "ignore", "忽略的配置项、配置文件或 key, 支持通配符, 可以重复")
+	secretKeys := fs.String("secret-keys", strings.Join(c.secretKeys, disconf.COMMA_SPLIT), "敏感 key 的通配符, 逗号分隔, 默认与全局参数相同")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c.secretKeys = splitList(*secretKeys)
+	fetcher, err := c.fetcher()
+	if err != nil {
+		return err
+	}
+	from, err := fetcher.FetchAll(context.Background(), c.app, c.version, c.env)
+	if err != nil {
+		return err
+	}
+	toFetcher, err := disconf.NewFetcher(*toHost, c.options()...)
+	if err != nil {
+		return err
+	}
+	to, err := toFetcher.FetchAll(context.Background(), *toApp, *toVersion, *toEnv)
+	if err != nil {
+		return err
+	}
+	changes := diffConfigs(from, to, ignore)
+	fmt.Fprintf(c.stdout, "--- %v/%v/%v\n+++ %v/%v/%v\n", from.App, from.Version, from.Env, to.App, to.Version, to.Env)
+	for _, ch := range changes {
+		fmt.Fprintln(c.stdout, c.maskChange(ch))
+	}
+	if len(changes) > 0 {
+		return errDiff
+	}
+	return nil
+}
+
+// 按原值比较, 输出时掩码, 敏感值变化时输出 ~ key: ****** -> ******
+func (c *cli) maskChange(ch change) change {
+	ch.from, ch.to = c.mask(ch.key, ch.from), c.mask(ch.key, ch.to)
+	return ch
+}
+
+func (ch change) String() string {
+	name := "item " + ch.key
+	if ch.file != disconf.EMPTY_STRING {
+		name = "file " + ch.file
+		if ch.key != disconf.EMPTY_STRING {
+			name += " " + ch.key
+		}
+	}
+	if ch.key == disconf.EMPTY_STRING && ch.file != disconf.EMPTY_STRING {
+		return fmt.Sprintf("%v %v", ch.kind, name)
+	}
+	switch ch.kind {
+	case CHANGE_ADDED:
+		return fmt.Sprintf("%v %v=%v", ch.kind, name, ch.to)
+	case CHANGE_REMOVED:
+		return fmt.Sprintf("%v %v=%v", ch.kind, name, ch.from)
+	}
+	return fmt.Sprintf("%v %v: %v -> %v", ch.kind, name, ch.from, ch.to)
+}
+
+// 配置项按 key 排序在前, 配置文件按文件名和 key 排序在后
+// 只在一方存在的配置文件整体报告, 两方都有的 properties 文件逐个 key 比较, 其他文件比较内容, 不同时整体报告为 ~
+func diffConfigs(from, to *disconf.RemoteConfig, ignore []string) []change {
+	changes := diffKvs(disconf.EMPTY_STRING, from.Items, to.Items, ignore)
+	fromFiles, toFiles := fileNames(from), fileNames(to)
+	names := []string{}
+	for name := range fromFiles {
+		names = append(names, name)
+	}
+	for name := range toFiles {
+		if !fromFiles[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ignored(ignore, name) {
+			continue
+		}
+		switch {
+		case !toFiles[name]:
+			changes = append(changes, change{kind: CHANGE_REMOVED, file: name})
+		case !fromFiles[name]:
+			changes = append(changes, change{kind: CHANGE_ADDED, file: name})
+		case strings.HasSuffix(name, disconf.FILE_PROPERTIES):
+			changes = append(changes, diffKvs(name, from.Files[name], to.Files[name], ignore)...)
+		case fileValue(from, name) != fileValue(to, name):
+			changes = append(changes, change{kind: CHANGE_CHANGED, file: name})
+		}
+	}
+	return changes
+}
+
+func diffKvs(file string, from, to map[string]string, ignore []string) []change {
+	keys := sortedKeys(from)
+	for key := range to {
+		if _, ok := from[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	changes := []change{}
+	for _, key := range keys {
+		if ignored(ignore, key) {
+			continue
+		}
+		fromValue, inFrom := from[key]
+		toValue, inTo := to[key]
+		switch {
+		case !inTo:
+			changes = append(changes, change{kind: CHANGE_REMOVED, file: file, key: key, from: fromValue})
+		case !inFrom:
+			changes = append(changes, change{kind: CHANGE_ADDED, file: file, key: key, to: toValue})
+		case fromValue != toValue:
+			changes = append(changes, change{kind: CHANGE_CHANGED, file: file, key: key, from: fromValue, to: toValue})
+		}
+	}
+	return changes
+}
+
+func fileNames(remote *disconf.RemoteConfig) map[string]bool {
+	names := make(map[string]bool)
+	for _, conf := range remote.Confs {
+		if conf.Genre == disconf.DISCONF_TYPE_FILE {
+			names[conf.Name] = true
+		}
+	}
+	return names
+}
+
+// 服务端配置列表中文件的内容
+func fileValue(remote *disconf.RemoteConfig, name string) string {
+	for _, conf := range remote.Confs {
+		if conf.Genre == disconf.DISCONF_TYPE_FILE && conf.Name == name {
+			return conf.Value
+		}
+	}
+	return disconf.EMPTY_STRING
+}
+
+func ignored(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
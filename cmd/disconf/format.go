@@ -0,0 +1,89 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 不需要加引号的 yaml key, 排除会被解析为 bool 或 null 的值
+var (
+	plainYamlKey    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.\-/]*$`)
+	reservedYamlKey = regexp.MustCompile(`^(?i:true|false|yes|no|on|off|y|n|null)$`)
+)
+
+// 按 key 排序输出
+func writeKvs(w io.Writer, kvs map[string]string, format string) error {
+	switch format {
+	case FORMAT_PROPERTIES:
+		for _, key := range sortedKeys(kvs) {
+			if _, err := fmt.Fprintf(w, "%v=%v\n", escapeProperties(key, true), escapeProperties(kvs[key], false)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FORMAT_JSON:
+		buf := &bytes.Buffer{}
+		encoder := json.NewEncoder(buf)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(kvs); err != nil {
+			return err
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	case FORMAT_YAML:
+		for _, key := range sortedKeys(kvs) {
+			if _, err := fmt.Fprintf(w, "%v: %v\n", yamlKey(key), strconv.Quote(kvs[key])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format [format:%v]", format)
+}
+
+// properties 文件的转义, key 中的分隔符和值开头的空格需要转义
+func escapeProperties(s string, key bool) string {
+	buf := &strings.Builder{}
+	for i, r := range s {
+		switch r {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '=', ':', '#', '!', ' ':
+			if key || i == 0 {
+				buf.WriteRune('\\')
+			}
+			buf.WriteRune(r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// strconv.Quote 的转义都是合法的 yaml 双引号字符串
+func yamlKey(key string) string {
+	if plainYamlKey.MatchString(key) && !reservedYamlKey.MatchString(key) {
+		return key
+	}
+	return strconv.Quote(key)
+}
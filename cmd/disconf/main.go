@@ -0,0 +1,377 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+// disconf 命令行工具, 通过与客户端相同的 Fetcher 查看服务端的配置和实例上报的值:
+//
+//	disconf -host 10.0.0.1:8080,10.0.0.2:8080 -app demo -version 1_0_0_0 -env dev list
+//	disconf ... item <key>
+//	disconf ... download [-dir ./disconf/download/] [file...]
+//	disconf ... dump [-format properties|json|yaml]
+//	disconf ... instances [key...]
+//	disconf ... diff [-to-env prod] [-ignore pattern]
+//	disconf ... watch [-count n]
+//	disconf -user admin ... set-item|set-file|delete|notify [-dry-run] ...
+//
+// -host 为逗号分隔的服务端地址, 依次重试; zk 认证和 chroot 与 WithZkDigestAuth、WithZkChroot 相同
+// list、dump、diff 和 watch 输出时, -secret-keys 匹配的 key 和 ENC(...) 加密值替换为 ******, 与 WithSecretKeys 相同
+// 写操作通过 disconf-web 的管理接口, 密码可以用环境变量 DISCONF_PASSWORD 设置
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+)
+
+const (
+	FORMAT_PROPERTIES = "properties"
+	FORMAT_JSON       = "json"
+	FORMAT_YAML       = "yaml"
+	EXIT_OK           = 0
+	EXIT_ERR          = 1
+	EXIT_USAGE        = 2
+	// 默认按敏感处理的 key, -secret-keys "" 时只掩码 ENC(...) 加密值
+	DEFAULT_SECRET_KEYS = "*password*,*secret*,*token*,*credential*"
+)
+
+// 命令行的公共参数
+type cli struct {
+	host       string
+	app        string
+	version    string
+	env        string
+	retry      int
+	retrySleep int
+	charset    string
+	zkDigest   string
+	zkChroot   string
+	user       string
+	password   string
+	secretKeys []string
+	stdout     io.Writer
+	stderr     io.Writer
+}
+
+type command struct {
+	args string
+	desc string
+	run  func(c *cli, args []string) error
+}
+
+// 查看和监听 zk 节点, 默认为 disconf.NewWatch, 测试时替换
+type zkWatch interface {
+	disconf.IWatch
+	KeyInstances(key string, disconfType int) (map[string][]byte, error)
+	Close()
+}
+
+var dialWatch = func(fetcher disconf.IFetcher, app, version, env string, opts ...disconf.ClientOption) (zkWatch, error) {
+	return disconf.NewWatch(fetcher, app, version, env, opts...)
+}
+
+var commands = map[string]command{
+	"list":      {"", "列出配置项和配置文件", (*cli).list},
+	"item":      {"<key>", "打印配置项的值", (*cli).item},
+	"download":  {"[-dir d] [file...]", "下载配置文件, 默认下载所有", (*cli).download},
+	"dump":      {"[-format f]", "打印合并后的 key/value, 格式为 properties、json 或 yaml", (*cli).dump},
+	"instances": {"[key...]", "打印各实例在 zk 中上报的值", (*cli).instances},
+	"set-item":  {"[-dry-run] <key> <value>", "新建或更新配置项", (*cli).setItem},
+	"set-file":  {"[-dry-run] [-name n] <path>", "新建或更新配置文件", (*cli).setFile},
+	"delete":    {"[-dry-run] [-file] <name>", "删除配置项或配置文件", (*cli).delete},
+	"notify":    {"[-dry-run] [-file] <name>", "把当前的值写入 zk 节点, 通知客户端重新加载", (*cli).notify},
+	"watch":     {"[-count n]", "监听配置变化, 打印时间和变化前后的差异", (*cli).watch},
+	"diff":      {"[-to-host h] [-to-app a] [-to-version v] [-to-env e] [-ignore p]...", "比较两组配置, 有差异时退出码为 3", (*cli).diff},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	c := &cli{stdout: stdout, stderr: stderr}
+	fs := flag.NewFlagSet("disconf", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&c.host, "host", "127.0.0.1:8080", "disconf 服务端地址, 逗号分隔")
+	fs.StringVar(&c.app, "app", "", "app")
+	fs.StringVar(&c.version, "version", "", "version")
+	fs.StringVar(&c.env, "env", "", "env")
+	fs.IntVar(&c.retry, "retry", disconf.RETRY_TIMES, "每个服务端的重试次数")
+	fs.IntVar(&c.retrySleep, "retry-sleep", disconf.RETRY_SLEEP_SECONDS, "重试间隔 (s)")
+	fs.StringVar(&c.charset, "charset", "", "properties 文件编码, 默认 utf-8")
+	fs.StringVar(&c.zkDigest, "zk-digest", "", "zk digest 认证, 格式为 user:password")
+	fs.StringVar(&c.zkChroot, "zk-chroot", "", "zk 路径前缀")
+	secretKeys := fs.String("secret-keys", DEFAULT_SECRET_KEYS, "敏感 key 的通配符, 逗号分隔, 输出时值替换为 "+disconf.SECRET_MASK)
+	// 环境变量在解析后读取, 不作为默认值, 避免用法说明中打印密码
+	fs.StringVar(&c.user, "user", "", "管理接口用户, 默认为环境变量 "+ENV_USER)
+	fs.StringVar(&c.password, "password", "", "管理接口密码, 默认为环境变量 "+ENV_PASSWORD)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: disconf [flags] <command> [args]\n\ncommands:\n")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w := tabwriter.NewWriter(stderr, 0, 4, 2, ' ', 0)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %v %v\t%v\n", name, commands[name].args, commands[name].desc)
+		}
+		w.Flush()
+		fmt.Fprintf(stderr, "\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+	c.secretKeys = splitList(*secretKeys)
+	if c.user == disconf.EMPTY_STRING {
+		c.user = os.Getenv(ENV_USER)
+	}
+	if c.password == disconf.EMPTY_STRING {
+		c.password = os.Getenv(ENV_PASSWORD)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return EXIT_USAGE
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command [command:%v]\n", fs.Arg(0))
+		fs.Usage()
+		return EXIT_USAGE
+	}
+	if err := cmd.run(c, fs.Args()[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_USAGE
+		}
+		if err == errDiff {
+			return EXIT_DIFF
+		}
+		fmt.Fprintf(stderr, "%v: %v\n", fs.Arg(0), err)
+		return EXIT_ERR
+	}
+	return EXIT_OK
+}
+
+func (c *cli) options() []disconf.ClientOption {
+	opts := []disconf.ClientOption{
+		disconf.WithRetryTimes(c.retry),
+		disconf.WithRetrySleepSeconds(c.retrySleep),
+	}
+	if c.charset != disconf.EMPTY_STRING {
+		opts = append(opts, disconf.WithCharset(c.charset))
+	}
+	if c.zkDigest != disconf.EMPTY_STRING {
+		user, password, _ := strings.Cut(c.zkDigest, ":")
+		opts = append(opts, disconf.WithZkDigestAuth(user, password))
+	}
+	if c.zkChroot != disconf.EMPTY_STRING {
+		opts = append(opts, disconf.WithZkChroot(c.zkChroot))
+	}
+	return opts
+}
+
+func (c *cli) fetcher(opts ...disconf.ClientOption) (*disconf.Fetcher, error) {
+	if c.app == disconf.EMPTY_STRING || c.version == disconf.EMPTY_STRING || c.env == disconf.EMPTY_STRING {
+		return nil, fmt.Errorf("-app, -version and -env are required")
+	}
+	return disconf.NewFetcher(c.host, append(c.options(), opts...)...)
+}
+
+func (c *cli) suffixUrl(key string) string {
+	suffix := fmt.Sprintf(disconf.SUFFIX_PREFIX_URL, c.app, c.env, c.version)
+	if key != disconf.EMPTY_STRING {
+		suffix += fmt.Sprintf(disconf.SUFFIX_KEY, key)
+	}
+	return suffix
+}
+
+func (c *cli) confs() ([]*disconf.Result, error) {
+	fetcher, err := c.fetcher()
+	if err != nil {
+		return nil, err
+	}
+	confs, errs := fetcher.GetAllConf(context.Background(), c.suffixUrl(disconf.EMPTY_STRING))
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("get all conf [errs:%v]", errs)
+	}
+	return confs, nil
+}
+
+func (c *cli) list(args []string) error {
+	confs, err := c.confs()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNAME\tVALUE")
+	for _, conf := range confs {
+		value := conf.Value
+		if conf.Genre == disconf.DISCONF_TYPE_FILE {
+			value = disconf.EMPTY_STRING
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", typeName(conf.Genre), conf.Name, c.mask(conf.Name, value))
+	}
+	return w.Flush()
+}
+
+func (c *cli) item(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: item <key>")
+	}
+	fetcher, err := c.fetcher()
+	if err != nil {
+		return err
+	}
+	value, errs := fetcher.GetValue(context.Background(), c.suffixUrl(args[0]))
+	if len(errs) > 0 {
+		return fmt.Errorf("get value [key:%v] [errs:%v]", args[0], errs)
+	}
+	fmt.Fprintln(c.stdout, value)
+	return nil
+}
+
+func (c *cli) download(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	dir := fs.String("dir", disconf.DEFAULT_DOWNLOAD_DIR, "下载目录")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	names := fs.Args()
+	if len(names) == 0 {
+		confs, err := c.confs()
+		if err != nil {
+			return err
+		}
+		for _, conf := range confs {
+			if conf.Genre == disconf.DISCONF_TYPE_FILE {
+				names = append(names, conf.Name)
+			}
+		}
+	}
+	downloadDir := strings.TrimSuffix(*dir, "/") + "/"
+	fetcher, err := c.fetcher(disconf.WithDownloadDir(downloadDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if errs := fetcher.DownloadFile(context.Background(), c.suffixUrl(name), name); len(errs) > 0 {
+			return fmt.Errorf("download file [fileName:%v] [errs:%v]", name, errs)
+		}
+		fmt.Fprintln(c.stdout, downloadDir+name)
+	}
+	return nil
+}
+
+func (c *cli) dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	format := fs.String("format", FORMAT_PROPERTIES, "properties、json 或 yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fetcher, err := c.fetcher()
+	if err != nil {
+		return err
+	}
+	remote, err := fetcher.FetchAll(context.Background(), c.app, c.version, c.env)
+	if err != nil {
+		return err
+	}
+	return writeKvs(c.stdout, c.maskMap(remote.Merged()), *format)
+}
+
+func (c *cli) mask(key, value string) string {
+	if value == disconf.EMPTY_STRING {
+		return value
+	}
+	return disconf.MaskValue(key, value, c.secretKeys...)
+}
+
+func (c *cli) maskMap(m map[string]string) map[string]string {
+	masked := make(map[string]string, len(m))
+	for k, v := range m {
+		masked[k] = c.mask(k, v)
+	}
+	return masked
+}
+
+func (c *cli) instances(args []string) error {
+	confs, err := c.confs()
+	if err != nil {
+		return err
+	}
+	fetcher, err := c.fetcher()
+	if err != nil {
+		return err
+	}
+	watch, err := dialWatch(fetcher, c.app, c.version, c.env, c.options()...)
+	if err != nil {
+		return err
+	}
+	defer watch.Close()
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNAME\tINSTANCE\tVALUE")
+	for _, conf := range confs {
+		if len(args) > 0 && !contains(args, conf.Name) {
+			continue
+		}
+		instances, err := watch.KeyInstances(conf.Name, conf.Genre)
+		if err != nil {
+			return fmt.Errorf("get instances [key:%v] [err:%v]", conf.Name, err)
+		}
+		for _, instance := range sortedKeys(instances) {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%s\n", typeName(conf.Genre), conf.Name, instance, instances[instance])
+		}
+	}
+	return w.Flush()
+}
+
+func typeName(disconfType int) string {
+	switch disconfType {
+	case disconf.DISCONF_TYPE_ITEM:
+		return "item"
+	case disconf.DISCONF_TYPE_FILE:
+		return "file"
+	}
+	return fmt.Sprintf("unknown(%v)", disconfType)
+}
+
+// 逗号分隔的列表, 忽略空项
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != disconf.EMPTY_STRING {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,306 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+	"github.com/scriptllh/go-disconf-client/disconftest"
+)
+
+func newTestServer() *disconftest.Server {
+	server := disconftest.NewServer()
+	server.SetItem("timeout", "3s")
+	server.SetItem("mysql.password", "p=w d")
+	server.SetFile("jdbc.properties", []byte("mysql.username=root\nmysql.password=secret\n"))
+	server.SetFile("logo.png", []byte("png"))
+	return server
+}
+
+func runCli(t *testing.T, server *disconftest.Server, args ...string) (string, int) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	args = append([]string{"-host", server.URL, "-app", "demo", "-version", "1_0_0_0", "-env", "dev", "-retry", "0"}, args...)
+	code := run(args, stdout, stderr)
+	if code != EXIT_OK {
+		t.Logf("stderr: %v", stderr.String())
+	}
+	return stdout.String(), code
+}
+
+func TestList(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	out, code := runCli(t, server, "list")
+	if code != EXIT_OK || !strings.Contains(out, "timeout") || !strings.Contains(out, "jdbc.properties") ||
+		!strings.Contains(out, disconf.SECRET_MASK) || strings.Contains(out, "p=w d") {
+		t.Fatalf("unexpected list [code:%v] [out:%v]", code, out)
+	}
+	if out, code = runCli(t, server, "item", "timeout"); code != EXIT_OK || out != "3s\n" {
+		t.Fatalf("unexpected item [code:%v] [out:%v]", code, out)
+	}
+	if _, code = runCli(t, server, "missing"); code != EXIT_USAGE {
+		t.Fatalf("unexpected code for unknown command [code:%v]", code)
+	}
+}
+
+func TestUsageHidesPassword(t *testing.T) {
+	os.Setenv(ENV_PASSWORD, "hunter2")
+	defer os.Unsetenv(ENV_PASSWORD)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := run([]string{"bogus"}, stdout, stderr); code != EXIT_USAGE || strings.Contains(stderr.String(), "hunter2") {
+		t.Fatalf("password printed in usage [code:%v] [stderr:%v]", code, stderr)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "disconf")
+	if err != nil {
+		t.Fatalf("temp dir [err:%v]", err)
+	}
+	defer os.RemoveAll(dir)
+	if out, code := runCli(t, server, "download", "-dir", dir); code != EXIT_OK || strings.Count(out, "\n") != 2 {
+		t.Fatalf("unexpected download [code:%v] [out:%v]", code, out)
+	}
+	data, err := ioutil.ReadFile(dir + "/logo.png")
+	if err != nil || string(data) != "png" {
+		t.Fatalf("unexpected file [data:%s] [err:%v]", data, err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	server.SetItem("api.key", "ENC(abc)")
+	expected := map[string]string{
+		FORMAT_PROPERTIES: "api.key=******\nmysql.password=******\nmysql.username=root\ntimeout=3s\n",
+		FORMAT_JSON:       "{\n  \"api.key\": \"******\",\n  \"mysql.password\": \"******\",\n  \"mysql.username\": \"root\",\n  \"timeout\": \"3s\"\n}\n",
+		FORMAT_YAML:       "api.key: \"******\"\nmysql.password: \"******\"\nmysql.username: \"root\"\ntimeout: \"3s\"\n",
+	}
+	for format, want := range expected {
+		if out, code := runCli(t, server, "dump", "-format", format); code != EXIT_OK || out != want {
+			t.Fatalf("unexpected dump [format:%v] [code:%v] [out:%v]", format, code, out)
+		}
+	}
+	if out, code := runCli(t, server, "-secret-keys", "", "dump"); code != EXIT_OK ||
+		out != "api.key=******\nmysql.password=secret\nmysql.username=root\ntimeout=3s\n" {
+		t.Fatalf("unexpected dump without secret keys [code:%v] [out:%v]", code, out)
+	}
+	if _, code := runCli(t, server, "dump", "-format", "xml"); code != EXIT_ERR {
+		t.Fatalf("unexpected code for unknown format [code:%v]", code)
+	}
+	if got := escapeProperties("p=w d", false) + "|" + escapeProperties("a b:c", true); got != `p=w d|a\ b\:c` {
+		t.Fatalf("unexpected escape [got:%v]", got)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	watch := server.Watch()
+	watch.SetZkValue("/disconf/item/timeout/10.0.0.1_8080_a", []byte("3s"))
+	watch.SetZkValue("/disconf/item/timeout/10.0.0.2_8080_b", []byte("2s"))
+	defer func(dial func(disconf.IFetcher, string, string, string, ...disconf.ClientOption) (zkWatch, error)) {
+		dialWatch = dial
+	}(dialWatch)
+	dialWatch = func(fetcher disconf.IFetcher, app, version, env string, opts ...disconf.ClientOption) (zkWatch, error) {
+		return watch, nil
+	}
+	out, code := runCli(t, server, "instances", "timeout")
+	if code != EXIT_OK || !strings.Contains(out, "10.0.0.1_8080_a  3s") || !strings.Contains(out, "10.0.0.2_8080_b  2s") {
+		t.Fatalf("unexpected instances [code:%v] [out:%v]", code, out)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	prod := server.App("demo", "1_0_0_0", "prod")
+	prod.SetItem("timeout", "5s")
+	prod.SetItem("local.debug", "true")
+	prod.SetFile("jdbc.properties", []byte("mysql.username=root\nmysql.url=prod\n"))
+	prod.SetFile("extra.properties", []byte("a=1\n"))
+	out, code := runCli(t, server, "diff", "-to-env", "prod", "-ignore", "local.*")
+	expected := strings.Join([]string{
+		"--- demo/1_0_0_0/dev",
+		"+++ demo/1_0_0_0/prod",
+		"- item mysql.password=******",
+		"~ item timeout: 3s -> 5s",
+		"+ file extra.properties",
+		"- file jdbc.properties mysql.password=******",
+		"+ file jdbc.properties mysql.url=prod",
+		"- file logo.png",
+	}, "\n") + "\n"
+	if code != EXIT_DIFF || out != expected {
+		t.Fatalf("unexpected diff [code:%v] [out:%v]", code, out)
+	}
+	prod.SetItem("mysql.password", "other")
+	if out, code = runCli(t, server, "diff", "-to-env", "prod", "-ignore", "local.*", "-ignore", "*.properties", "-ignore", "timeout"); code != EXIT_DIFF ||
+		!strings.Contains(out, "~ item mysql.password: ****** -> ******\n") {
+		t.Fatalf("unexpected secret diff [code:%v] [out:%v]", code, out)
+	}
+	if out, code = runCli(t, server, "diff", "-to-env", "prod", "-secret-keys", "", "-ignore", "local.*"); code != EXIT_DIFF ||
+		!strings.Contains(out, "~ item mysql.password: p=w d -> other\n") {
+		t.Fatalf("unexpected diff without secret keys [code:%v] [out:%v]", code, out)
+	}
+	if out, code = runCli(t, server, "diff"); code != EXIT_OK || strings.Count(out, "\n") != 2 {
+		t.Fatalf("unexpected diff with itself [code:%v] [out:%v]", code, out)
+	}
+	// 非 properties 文件比较内容
+	only := []string{"diff", "-to-env", "prod", "-ignore", "*.properties", "-ignore", "local.*", "-ignore", "timeout", "-ignore", "mysql.password"}
+	prod.SetFile("logo.png", []byte("png"))
+	if out, code = runCli(t, server, only...); code != EXIT_OK || strings.Count(out, "\n") != 2 {
+		t.Fatalf("unexpected diff of same file [code:%v] [out:%v]", code, out)
+	}
+	prod.SetFile("logo.png", []byte("png2"))
+	if out, code = runCli(t, server, only...); code != EXIT_DIFF || !strings.HasSuffix(out, "\n~ file logo.png\n") {
+		t.Fatalf("unexpected diff of changed file [code:%v] [out:%v]", code, out)
+	}
+}
+
+// 可以在其他 goroutine 中读取的输出
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestWatch(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	defer func(dial func(disconf.IFetcher, string, string, string, ...disconf.ClientOption) (zkWatch, error)) {
+		dialWatch = dial
+	}(dialWatch)
+	dialWatch = func(fetcher disconf.IFetcher, app, version, env string, opts ...disconf.ClientOption) (zkWatch, error) {
+		return server.Watch(), nil
+	}
+	stdout, stderr := &syncBuffer{}, &syncBuffer{}
+	done := make(chan int)
+	go func() {
+		done <- run([]string{"-host", server.URL, "-app", "demo", "-version", "1_0_0_0", "-env", "dev", "-retry", "0",
+			"watch", "-count", "2"}, stdout, stderr)
+	}()
+	waitOutput := func(s string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(stdout.String(), s) {
+			if time.Now().After(deadline) {
+				t.Fatalf("wait output timeout [want:%v] [stdout:%v] [stderr:%v]", s, stdout, stderr)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitOutput("watching 4 configs")
+	server.UpdateItem("timeout", "5s")
+	// 等第一次变化处理完, 否则两次变化可能在同一次获取中
+	waitOutput("~ item timeout")
+	server.UpdateFile("jdbc.properties", []byte("mysql.username=admin\nmysql.password=changed\n"))
+	if code := <-done; code != EXIT_OK {
+		t.Fatalf("unexpected code [code:%v] [stderr:%v]", code, stderr)
+	}
+	out := stdout.String()
+	for _, s := range []string{"item timeout version 1", "  ~ item timeout: 3s -> 5s", "file jdbc.properties version 1",
+		"  ~ file jdbc.properties mysql.username: root -> admin", "  ~ file jdbc.properties mysql.password: ****** -> ******"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing event [event:%v] [out:%v]", s, out)
+		}
+	}
+	if strings.Contains(out, "changed") {
+		t.Fatalf("secret printed [out:%v]", out)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	server.SetAdmin("admin", "secret")
+	dev := server.App("demo", "1_0_0_0", "dev")
+	dev.SetItem("timeout", "3s")
+	defer func(dial func(disconf.IFetcher, string, string, string, ...disconf.ClientOption) (zkWatch, error)) {
+		dialWatch = dial
+	}(dialWatch)
+	dialWatch = func(fetcher disconf.IFetcher, app, version, env string, opts ...disconf.ClientOption) (zkWatch, error) {
+		return dev.Watch(), nil
+	}
+	if out, code := runCli(t, server, "set-item", "-dry-run", "timeout", "5s"); code != EXIT_OK || !strings.HasPrefix(out, "dry run: PUT") {
+		t.Fatalf("unexpected dry run [code:%v] [out:%v]", code, out)
+	}
+	if _, code := runCli(t, server, "set-item", "timeout", "5s"); code != EXIT_ERR {
+		t.Fatalf("set item without user [code:%v]", code)
+	}
+	admin := func(args ...string) (string, int) {
+		return runCli(t, server, append([]string{"-user", "admin", "-password", "secret"}, args...)...)
+	}
+	if out, code := admin("set-item", "timeout", "5s"); code != EXIT_OK || !strings.HasPrefix(out, "PUT") {
+		t.Fatalf("unexpected set item [code:%v] [out:%v]", code, out)
+	}
+	if out, code := admin("set-item", "timeout", "5s"); code != EXIT_OK || out != "unchanged\n" {
+		t.Fatalf("unexpected unchanged item [code:%v] [out:%v]", code, out)
+	}
+	dir, err := ioutil.TempDir("", "disconf")
+	if err != nil {
+		t.Fatalf("temp dir [err:%v]", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/jdbc.properties", []byte("mysql.username=root\n"), 0644); err != nil {
+		t.Fatalf("write file [err:%v]", err)
+	}
+	if out, code := admin("set-file", dir+"/jdbc.properties"); code != EXIT_OK || !strings.HasPrefix(out, "POST") {
+		t.Fatalf("unexpected set file [code:%v] [out:%v]", code, out)
+	}
+	if out, code := admin("notify", "timeout"); code != EXIT_OK || !strings.HasPrefix(out, "ZK_SET /disconf/demo_1_0_0_0_dev/item/timeout") {
+		t.Fatalf("unexpected notify [code:%v] [out:%v]", code, out)
+	}
+	if out, code := admin("delete", "-file", "jdbc.properties"); code != EXIT_OK || !strings.HasPrefix(out, "DELETE") {
+		t.Fatalf("unexpected delete [code:%v] [out:%v]", code, out)
+	}
+	if out, code := runCli(t, server, "dump"); code != EXIT_OK || out != "timeout=5s\n" {
+		t.Fatalf("unexpected dump [code:%v] [out:%v]", code, out)
+	}
+	// 敏感值不出现在输出和 zk 节点中
+	for _, args := range [][]string{{"-dry-run", "mysql.password", "hunter2"}, {"mysql.password", "hunter2"}} {
+		if out, code := admin(append([]string{"set-item"}, args...)...); code != EXIT_OK ||
+			strings.Contains(out, "hunter2") || !strings.Contains(out, "value="+disconf.SECRET_MASK) {
+			t.Fatalf("secret leaked [code:%v] [out:%v]", code, out)
+		}
+	}
+	if err := ioutil.WriteFile(dir+"/secret.properties", []byte("mysql.password=hunter2"), 0644); err != nil {
+		t.Fatalf("write file [err:%v]", err)
+	}
+	if out, code := admin("set-file", dir+"/secret.properties"); code != EXIT_OK || strings.Contains(out, "hunter2") {
+		t.Fatalf("secret leaked [code:%v] [out:%v]", code, out)
+	}
+	for _, args := range [][]string{{"mysql.password"}, {"-file", "secret.properties"}} {
+		if out, code := admin(append([]string{"notify"}, args...)...); code != EXIT_OK {
+			t.Fatalf("unexpected notify [code:%v] [out:%v]", code, out)
+		}
+	}
+	for key, disconfType := range map[string]int{"mysql.password": disconf.DISCONF_TYPE_ITEM, "secret.properties": disconf.DISCONF_TYPE_FILE} {
+		path, _ := dev.Watch().GetBaseUrl(key, disconfType)
+		if value, _ := dev.Watch().Node(path); strings.Contains(string(value), "hunter2") || len(value) == 0 {
+			t.Fatalf("secret leaked to zk [key:%v] [value:%s]", key, value)
+		}
+	}
+}
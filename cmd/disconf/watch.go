@@ -0,0 +1,87 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+)
+
+const (
+	// WatchPath 出错 (如 zk 连接断开) 后重新监听的间隔, 节点还没有创建时 WatchPath 会等待, 不会出错
+	WATCH_RETRY_INTERVAL = time.Second
+	WATCH_TIME_FORMAT    = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// 监听所有配置项和配置文件的 zk 节点, 不注册实例, 每次变化重新获取配置并打印与上一次的差异,
+// 敏感值按 -secret-keys 掩码:
+//
+//	2018-01-25T16:08:29.000+08:00 item timeout version 3
+//	  ~ item timeout: 3s -> 5s
+func (c *cli) watch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	count := fs.Int("count", 0, "收到 count 次变化后退出, 0 为不退出")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fetcher, err := c.fetcher()
+	if err != nil {
+		return err
+	}
+	current, err := fetcher.FetchAll(context.Background(), c.app, c.version, c.env)
+	if err != nil {
+		return err
+	}
+	watch, err := dialWatch(fetcher, c.app, c.version, c.env, c.options()...)
+	if err != nil {
+		return err
+	}
+	defer watch.Close()
+	respChan := make(chan disconf.WatchResponse)
+	watching := make(map[string]bool)
+	watchNew := func(confs []*disconf.Result) {
+		for _, conf := range confs {
+			if id := typeName(conf.Genre) + " " + conf.Name; !watching[id] {
+				watching[id] = true
+				go watch.WatchPath(conf.Name, conf.Genre, respChan)
+			}
+		}
+	}
+	watchNew(current.Confs)
+	fmt.Fprintf(c.stdout, "watching %v configs of %v/%v/%v\n", len(watching), c.app, c.version, c.env)
+	for events := 0; *count == 0 || events < *count; {
+		resp := <-respChan
+		if resp.Err != nil {
+			fmt.Fprintf(c.stderr, "watch [key:%v] [err:%v]\n", resp.Key, resp.Err)
+			time.AfterFunc(WATCH_RETRY_INTERVAL, func() {
+				watch.WatchPath(resp.Key, resp.DisconfType, respChan)
+			})
+			continue
+		}
+		go watch.WatchPath(resp.Key, resp.DisconfType, respChan)
+		events++
+		fmt.Fprintf(c.stdout, "%v %v %v version %v\n", time.Now().Format(WATCH_TIME_FORMAT),
+			typeName(resp.DisconfType), resp.Key, resp.Version)
+		latest, err := fetcher.FetchAll(context.Background(), c.app, c.version, c.env)
+		if err != nil {
+			fmt.Fprintf(c.stderr, "fetch [key:%v] [err:%v]\n", resp.Key, err)
+			continue
+		}
+		// 同时发生的其他变化也在这里打印, 之后它们的通知没有差异
+		for _, ch := range diffConfigs(current, latest, nil) {
+			fmt.Fprintf(c.stdout, "  %v\n", c.maskChange(ch))
+		}
+		current = latest
+		watchNew(current.Confs)
+	}
+	return nil
+}
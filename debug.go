@@ -0,0 +1,144 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 一个绑定到结构体字段的 key 当前生效的值
+// File 为提供该值的配置文件、环境变量或 flag 名
+type ConfigEntry struct {
+	Key    string `json:"key"`
+	Target string `json:"target"`
+	Field  string `json:"field"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	File   string `json:"file,omitempty"`
+	// 值来自 WithSubscription 订阅的 <app>_<version>_<env>
+	Subscription string    `json:"subscription,omitempty"`
+	Auto         bool      `json:"auto"`
+	Secret       bool      `json:"secret"`
+	UpdatedAt    time.Time `json:"updatedAt,omitempty"`
+	Version      int32     `json:"version"`
+}
+
+const (
+	SOURCE_DEFAULT     = "default"
+	SOURCE_REMOTE_ITEM = "remoteItem"
+	SOURCE_REMOTE_FILE = "remoteFile"
+	SOURCE_LOCAL_FILE  = "localFile"
+	SECRET_TAG         = "secret"
+	SECRET_TRUE        = "true"
+	SECRET_MASK        = "******"
+	DEBUG_FORMAT_JSON  = "json"
+)
+
+// 当前所有绑定 key 的值和来源, secret:"true" 的字段值会被掩码
+// 多个结构体绑定同一个 key 时每个字段一条
+func (s *Store) entries() []ConfigEntry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entries := []ConfigEntry{}
+	for _, t := range s.targets {
+		elems := reflect.TypeOf(t.conf).Elem()
+		values := reflect.ValueOf(t.conf).Elem()
+		for i := 0; i < elems.NumField(); i++ {
+			field := elems.Field(i)
+			tag := field.Tag.Get(CONF_TAG)
+			if tag == EMPTY_STRING {
+				continue
+			}
+			key := t.prefix + tag
+			entry := ConfigEntry{
+				Key:    key,
+				Target: elems.String(),
+				Field:  field.Name,
+				Type:   field.Type.String(),
+				Value:  fieldString(values.Field(i)),
+				Source: SOURCE_DEFAULT,
+				Auto:   field.Tag.Get(AUTO_TAG) == AUTO_TRUE || isDynamicType(field.Type),
+				Secret: s.isSecretLocked(key),
+			}
+			if o, ok := s.origins[t.originKey(key)]; ok {
+				entry.Secret = entry.Secret || o.encrypted
+				entry.Source = o.source
+				entry.File = o.file
+				entry.Subscription = o.subscription
+				entry.UpdatedAt = o.updatedAt
+				entry.Version = o.version
+			}
+			if entry.Secret {
+				entry.Value = SECRET_MASK
+			} else {
+				entry.Value = s.maskValueLocked(key, entry.Value)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+func fieldString(field reflect.Value) string {
+	if isDynamicType(field.Type()) {
+		if field.Kind() == reflect.Ptr && field.IsNil() {
+			return fmt.Sprint(nil)
+		}
+		if d, ok := dynamicFieldOf(field); ok {
+			return d.String()
+		}
+	}
+	return fmt.Sprint(field.Interface())
+}
+
+func (c *Client) Entries() []ConfigEntry {
+	return c.store.entries()
+}
+
+// 查看当前生效的配置, 默认输出文本表格, ?format=json 输出 json
+func (c *Client) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries := c.Entries()
+		if r.URL.Query().Get("format") == DEBUG_FORMAT_JSON || strings.HasSuffix(r.URL.Path, "."+DEBUG_FORMAT_JSON) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"app":     c.app,
+				"env":     c.env,
+				"version": c.version,
+				"entries": entries,
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "app=%v env=%v version=%v\n\n", c.app, c.env, c.version)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE\tFILE\tAUTO\tUPDATED\tVERSION")
+		for _, e := range entries {
+			updated := "-"
+			if !e.UpdatedAt.IsZero() {
+				updated = e.UpdatedAt.Format(time.RFC3339)
+			}
+			file := e.File
+			if file == EMPTY_STRING {
+				file = "-"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", e.Key, e.Value, e.Source, file, e.Auto, updated, e.Version)
+		}
+		tw.Flush()
+	})
+}
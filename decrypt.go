@@ -0,0 +1,133 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// 解密配置值
+type Decrypter interface {
+	Decrypt(ciphertext string) (string, error)
+}
+
+const (
+	DECRYPT_TAG       = "decrypt"
+	DEFAULT_DECRYPTER = "aes"
+	ENC_PREFIX        = "ENC("
+	ENC_SUFFIX        = ")"
+)
+
+// 注册解密器, 字段标签 decrypt:"<name>" 的值总是用 name 解密,
+// 其他字段中形如 ENC(...) 的值用 DEFAULT_DECRYPTER ("aes") 解密
+func WithDecrypter(name string, decrypter Decrypter) ClientOption {
+	return func(c *Client) {
+		if c.decrypters == nil {
+			c.decrypters = make(map[string]Decrypter)
+		}
+		c.decrypters[name] = decrypter
+	}
+}
+
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, ENC_PREFIX) && strings.HasSuffix(value, ENC_SUFFIX)
+}
+
+// 按字段标签或 ENC(...) 包装解密, 不需要解密时原样返回
+func (s *Store) decrypt(field reflect.StructField, value string) (string, error) {
+	name := field.Tag.Get(DECRYPT_TAG)
+	encrypted := isEncrypted(value)
+	if name == EMPTY_STRING && !encrypted {
+		return value, nil
+	}
+	if name == EMPTY_STRING {
+		name = DEFAULT_DECRYPTER
+	}
+	if encrypted {
+		value = value[len(ENC_PREFIX) : len(value)-len(ENC_SUFFIX)]
+	}
+	decrypter, ok := s.decrypters[name]
+	if !ok {
+		return EMPTY_STRING, fmt.Errorf("decrypter not found [name:%v]", name)
+	}
+	plaintext, err := decrypter.Decrypt(value)
+	if err != nil {
+		return EMPTY_STRING, fmt.Errorf("decrypt [decrypter:%v] [err:%v]", name, err)
+	}
+	return plaintext, nil
+}
+
+// AES-GCM 解密, 密文为 base64(nonce + ciphertext + tag)
+// 支持多个 key 便于轮换, 依次尝试
+type AesGcmDecrypter struct {
+	aeads []cipher.AEAD
+}
+
+// key 长度为 16、24 或 32 字节
+func NewAesGcmDecrypter(keys ...[]byte) (*AesGcmDecrypter, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no aes key")
+	}
+	d := &AesGcmDecrypter{}
+	for _, key := range keys {
+		aead, err := newAesGcm(key)
+		if err != nil {
+			return nil, err
+		}
+		d.aeads = append(d.aeads, aead)
+	}
+	return d, nil
+}
+
+func (d *AesGcmDecrypter) Decrypt(ciphertext string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(ciphertext))
+	if err != nil {
+		return EMPTY_STRING, err
+	}
+	var lastErr error
+	for _, aead := range d.aeads {
+		if len(data) < aead.NonceSize() {
+			return EMPTY_STRING, fmt.Errorf("ciphertext too short")
+		}
+		nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, sealed, nil)
+		if err == nil {
+			return string(plaintext), nil
+		}
+		lastErr = err
+	}
+	return EMPTY_STRING, lastErr
+}
+
+// 生成 AesGcmDecrypter 可解密的 ENC(...) 值, 用于准备配置
+func AesGcmEncrypt(key []byte, plaintext string) (string, error) {
+	aead, err := newAesGcm(key)
+	if err != nil {
+		return EMPTY_STRING, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return EMPTY_STRING, err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return ENC_PREFIX + base64.StdEncoding.EncodeToString(sealed) + ENC_SUFFIX, nil
+}
+
+func newAesGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
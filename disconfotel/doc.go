@@ -0,0 +1,12 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+// disconfotel 把 OpenTelemetry 适配为 disconf_client.Tracer
+// 依赖 go.opentelemetry.io/otel, 需要使用 -tags otel 编译
+//
+//	tracer := disconfotel.NewTracer(otel.GetTracerProvider(), otel.GetTextMapPropagator())
+//	NewConf(..., WithTracer(tracer))
+package disconfotel
@@ -0,0 +1,94 @@
+//go:build otel
+
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconfotel
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	INSTRUMENTATION_NAME = "github.com/scriptllh/go-disconf-client"
+	ATTRIBUTE_PREFIX     = "disconf."
+)
+
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// propagator 为 nil 时不向 disconf 服务端传递 trace context
+func NewTracer(provider trace.TracerProvider, propagator propagation.TextMapPropagator) *Tracer {
+	return &Tracer{
+		tracer:     provider.Tracer(INSTRUMENTATION_NAME),
+		propagator: propagator,
+	}
+}
+
+func (t *Tracer) Start(ctx context.Context, name string, fields ...disconf.Field) (context.Context, disconf.Span) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithAttributes(attributes(fields)...))
+	return ctx, &Span{span: span}
+}
+
+func (t *Tracer) Inject(ctx context.Context, header http.Header) {
+	if t.propagator == nil {
+		return
+	}
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+type Span struct {
+	span trace.Span
+}
+
+func (s *Span) SetAttributes(fields ...disconf.Field) {
+	s.span.SetAttributes(attributes(fields)...)
+}
+
+func (s *Span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *Span) End() {
+	s.span.End()
+}
+
+func attributes(fields []disconf.Field) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(fields))
+	for _, field := range fields {
+		key := ATTRIBUTE_PREFIX + field.Key
+		switch v := field.Value.(type) {
+		case string:
+			attrs = append(attrs, attribute.String(key, v))
+		case int:
+			attrs = append(attrs, attribute.Int(key, v))
+		case int32:
+			attrs = append(attrs, attribute.Int64(key, int64(v)))
+		case int64:
+			attrs = append(attrs, attribute.Int64(key, v))
+		case bool:
+			attrs = append(attrs, attribute.Bool(key, v))
+		case float64:
+			attrs = append(attrs, attribute.Float64(key, v))
+		case error:
+			attrs = append(attrs, attribute.String(key, v.Error()))
+		default:
+			attrs = append(attrs, attribute.String(key, fmt.Sprint(v)))
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,71 @@
+//go:build otel
+
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconfotel
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTracer(t *testing.T) {
+	traceId, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanId, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	parent := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceId, SpanID: spanId, TraceFlags: trace.FlagsSampled, Remote: true})
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+
+	tracer := NewTracer(noop.NewTracerProvider(), propagation.TraceContext{})
+	ctx, span := tracer.Start(ctx, disconf.SPAN_FETCH, disconf.F(disconf.LOG_FIELD_HOST, "h1"))
+	defer span.End()
+	if got := trace.SpanContextFromContext(ctx).TraceID(); got != traceId {
+		t.Fatalf("span not parented [traceId:%v]", got)
+	}
+	header := http.Header{}
+	tracer.Inject(ctx, header)
+	if traceparent := header.Get("traceparent"); !strings.Contains(traceparent, traceId.String()) {
+		t.Fatalf("trace context not injected [header:%v]", header)
+	}
+
+	header = http.Header{}
+	NewTracer(noop.NewTracerProvider(), nil).Inject(ctx, header)
+	if len(header) != 0 {
+		t.Fatalf("trace context injected without propagator [header:%v]", header)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	attrs := attributes([]disconf.Field{
+		disconf.F(disconf.LOG_FIELD_KEY, "a"),
+		disconf.F(disconf.LOG_FIELD_ZK_VERSION, int32(3)),
+		disconf.F(disconf.LOG_FIELD_ERR, fmt.Errorf("timeout")),
+		disconf.F("ok", true),
+	})
+	want := []attribute.KeyValue{
+		attribute.String("disconf.key", "a"),
+		attribute.Int64("disconf.zkVersion", 3),
+		attribute.String("disconf.err", "timeout"),
+		attribute.Bool("disconf.ok", true),
+	}
+	if len(attrs) != len(want) {
+		t.Fatalf("unexpected attributes [attrs:%v]", attrs)
+	}
+	for i := range want {
+		if attrs[i] != want[i] {
+			t.Fatalf("unexpected attribute [got:%v] [want:%v]", attrs[i], want[i])
+		}
+	}
+}
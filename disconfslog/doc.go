@@ -0,0 +1,11 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+// disconfslog 把 log/slog 适配为 disconf_client.Logger
+// log/slog 需要 Go 1.21, 更早的版本编译时该包为空, 不影响 disconf_client 本身
+//
+//	NewConf(..., WithLogger(disconfslog.NewLogger(slog.Default())))
+package disconfslog
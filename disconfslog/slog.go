@@ -0,0 +1,69 @@
+//go:build go1.21
+
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconfslog
+
+import (
+	"context"
+	"log/slog"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+)
+
+type Logger struct {
+	logger *slog.Logger
+}
+
+// logger 为 nil 时使用 slog.Default()
+func NewLogger(logger *slog.Logger) *Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Logger{logger: logger}
+}
+
+// error 按字符串输出, 避免 json handler 输出空对象
+func attrs(fields []disconf.Field) []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, field := range fields {
+		if err, ok := field.Value.(error); ok {
+			attrs = append(attrs, slog.String(field.Key, err.Error()))
+			continue
+		}
+		attrs = append(attrs, slog.Any(field.Key, field.Value))
+	}
+	return attrs
+}
+
+func (l *Logger) log(level slog.Level, msg string, fields []disconf.Field) {
+	l.logger.LogAttrs(context.Background(), level, msg, attrs(fields)...)
+}
+
+func (l *Logger) Debug(msg string, fields ...disconf.Field) {
+	l.log(slog.LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...disconf.Field) {
+	l.log(slog.LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...disconf.Field) {
+	l.log(slog.LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...disconf.Field) {
+	l.log(slog.LevelError, msg, fields)
+}
+
+func (l *Logger) With(fields ...disconf.Field) disconf.Logger {
+	args := make([]interface{}, 0, len(fields))
+	for _, attr := range attrs(fields) {
+		args = append(args, attr)
+	}
+	return &Logger{logger: l.logger.With(args...)}
+}
@@ -0,0 +1,35 @@
+//go:build go1.21
+
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconfslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"testing"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	var logger disconf.Logger = NewLogger(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	logger = logger.With(disconf.F(disconf.LOG_FIELD_APP, "demo"))
+	logger.Debug("hidden")
+	logger.Warn("auto load", disconf.F(disconf.LOG_FIELD_KEY, "a"), disconf.F(disconf.LOG_FIELD_ERR, fmt.Errorf("timeout")))
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("unmarshal [err:%v] [out:%v]", err, buf.String())
+	}
+	if record["level"] != "WARN" || record["msg"] != "auto load" || record["app"] != "demo" || record["key"] != "a" ||
+		record["err"] != "timeout" {
+		t.Fatalf("unexpected record [record:%v]", record)
+	}
+}
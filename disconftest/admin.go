@@ -0,0 +1,243 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconftest
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+)
+
+const (
+	ADMIN_COOKIE = "JSESSIONID"
+)
+
+// 管理接口的用户、会话和配置 id, 由 Server.mutex 保护
+type adminState struct {
+	user     string
+	password string
+	sessions map[string]bool
+	// 通过 App 创建的 app 和 env, id 为下标 + 1
+	appNames []string
+	envNames []string
+	versions map[string]bool
+	ids      map[configRef]int
+	refs     map[int]configRef
+}
+
+type configRef struct {
+	app   *AppConfig
+	genre int
+	name  string
+}
+
+func newAdminState() adminState {
+	return adminState{
+		sessions: make(map[string]bool),
+		versions: make(map[string]bool),
+		ids:      make(map[configRef]int),
+		refs:     make(map[int]configRef),
+	}
+}
+
+// 设置管理接口的用户, 新建配置时 app 和 env 需要先通过 App 创建
+func (s *Server) SetAdmin(user, password string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.admin.user, s.admin.password = user, password
+}
+
+func (a *adminState) register(app, version, env string) {
+	if indexOf(a.appNames, app) < 0 {
+		a.appNames = append(a.appNames, app)
+	}
+	if indexOf(a.envNames, env) < 0 {
+		a.envNames = append(a.envNames, env)
+	}
+	a.versions[version] = true
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// 配置在所有 app 中唯一且不变的 id
+func (s *Server) configId(a *AppConfig, genre int, name string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ref := configRef{app: a, genre: genre, name: name}
+	if id, ok := s.admin.ids[ref]; ok {
+		return id
+	}
+	id := len(s.admin.ids) + 1
+	s.admin.ids[ref] = id
+	s.admin.refs[id] = ref
+	return id
+}
+
+func (s *Server) handleAdmin(mux *http.ServeMux) {
+	mux.HandleFunc(disconf.DISCONF_SIGNIN_ACTION, s.handleSignin)
+	mux.HandleFunc(disconf.DISCONF_APP_LIST_ACTION, s.requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		s.writeEntities(w, func(a *adminState) []string { return a.appNames })
+	}))
+	mux.HandleFunc(disconf.DISCONF_ENV_LIST_ACTION, s.requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		s.writeEntities(w, func(a *adminState) []string { return a.envNames })
+	}))
+	mux.HandleFunc(disconf.DISCONF_WEB_ITEM_ACTION, s.requireLogin(s.handleCreate(disconf.DISCONF_TYPE_ITEM)))
+	mux.HandleFunc(disconf.DISCONF_WEB_FILETEXT_ACTION, s.requireLogin(s.handleCreate(disconf.DISCONF_TYPE_FILE)))
+	mux.HandleFunc(disconf.DISCONF_WEB_ITEM_ACTION+"/", s.requireLogin(s.handleUpdate(disconf.DISCONF_TYPE_ITEM)))
+	mux.HandleFunc(disconf.DISCONF_WEB_FILETEXT_ACTION+"/", s.requireLogin(s.handleUpdate(disconf.DISCONF_TYPE_FILE)))
+	mux.HandleFunc(disconf.DISCONF_WEB_CONFIG_ACTION+"/", s.requireLogin(s.handleDelete))
+}
+
+func writeResult(w http.ResponseWriter, status int, message string) {
+	success := disconf.STRING_TRUE
+	if status != http.StatusOK {
+		success = "false"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+	}
+	writeJson(w, map[string]interface{}{
+		"success": success,
+		"message": map[string]string{"global": message},
+	})
+}
+
+func (s *Server) handleSignin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeResult(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.admin.user == disconf.EMPTY_STRING || r.FormValue("name") != s.admin.user || r.FormValue("password") != s.admin.password {
+		writeResult(w, http.StatusUnauthorized, "wrong user or password")
+		return
+	}
+	session := strconv.Itoa(len(s.admin.sessions) + 1)
+	s.admin.sessions[session] = true
+	http.SetCookie(w, &http.Cookie{Name: ADMIN_COOKIE, Value: session, Path: "/"})
+	writeResult(w, http.StatusOK, "login success")
+}
+
+// 没有登录时返回 401
+func (s *Server) requireLogin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		cookie, err := r.Cookie(ADMIN_COOKIE)
+		ok := err == nil && s.admin.sessions[cookie.Value]
+		s.mutex.Unlock()
+		if !ok {
+			writeResult(w, http.StatusUnauthorized, "login required")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *Server) writeEntities(w http.ResponseWriter, names func(a *adminState) []string) {
+	s.mutex.Lock()
+	entities := []map[string]interface{}{}
+	for i, name := range names(&s.admin) {
+		entities = append(entities, map[string]interface{}{"id": i + 1, "name": name})
+	}
+	s.mutex.Unlock()
+	writeJson(w, map[string]interface{}{
+		"success": disconf.STRING_TRUE,
+		"page":    map[string]interface{}{"result": entities},
+	})
+}
+
+func (s *Server) handleCreate(genre int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeResult(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		appId, _ := strconv.Atoi(r.FormValue("appId"))
+		envId, _ := strconv.Atoi(r.FormValue("envId"))
+		s.mutex.Lock()
+		ok := appId > 0 && appId <= len(s.admin.appNames) && envId > 0 && envId <= len(s.admin.envNames) &&
+			s.admin.versions[r.FormValue("version")]
+		var app, env string
+		if ok {
+			app, env = s.admin.appNames[appId-1], s.admin.envNames[envId-1]
+		}
+		s.mutex.Unlock()
+		if !ok {
+			writeResult(w, http.StatusBadRequest, "unknown app, version or env")
+			return
+		}
+		a := s.App(app, r.FormValue("version"), env)
+		if genre == disconf.DISCONF_TYPE_ITEM {
+			a.SetItem(r.FormValue("key"), r.FormValue("value"))
+		} else {
+			a.SetFile(r.FormValue("fileName"), []byte(r.FormValue("fileContent")))
+		}
+		writeResult(w, http.StatusOK, "created")
+	}
+}
+
+// 与 disconf-web 相同, 更新后通知客户端
+func (s *Server) handleUpdate(genre int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			writeResult(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		ref, ok := s.configRef(r)
+		if !ok || ref.genre != genre {
+			writeResult(w, http.StatusNotFound, "config not found")
+			return
+		}
+		if genre == disconf.DISCONF_TYPE_ITEM {
+			ref.app.UpdateItem(ref.name, r.FormValue("value"))
+		} else {
+			ref.app.UpdateFile(ref.name, []byte(r.FormValue("fileContent")))
+		}
+		writeResult(w, http.StatusOK, "updated")
+	}
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeResult(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ref, ok := s.configRef(r)
+	if !ok {
+		writeResult(w, http.StatusNotFound, "config not found")
+		return
+	}
+	ref.app.mutex.Lock()
+	if ref.genre == disconf.DISCONF_TYPE_ITEM {
+		delete(ref.app.items, ref.name)
+	} else {
+		delete(ref.app.files, ref.name)
+	}
+	ref.app.mutex.Unlock()
+	writeResult(w, http.StatusOK, "deleted")
+}
+
+// 路径最后一段的配置 id
+func (s *Server) configRef(r *http.Request) (configRef, bool) {
+	id, err := strconv.Atoi(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+	if err != nil {
+		return configRef{}, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ref, ok := s.admin.refs[id]
+	return ref, ok
+}
@@ -0,0 +1,208 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+// disconftest 提供测试用的 disconf 服务端和 zookeeper watch
+package disconftest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+)
+
+const (
+	FAKE_ZK_HOSTS = "127.0.0.1:2181"
+)
+
+// 基于 httptest 的 disconf 服务端, 实现了
+// /api/zoo/hosts、/api/config/list、/api/config/item、/api/config/file 和 disconf.Admin 使用的管理接口
+// 内嵌的 AppConfig 为默认配置, 没有通过 App 单独设置的 app/version/env 都返回默认配置
+type Server struct {
+	*httptest.Server
+	*AppConfig
+	mutex sync.Mutex
+	apps  map[string]*AppConfig
+	// 管理接口的数据, 见 admin.go
+	admin adminState
+}
+
+// 一组 app/version/env 的配置
+type AppConfig struct {
+	mutex sync.Mutex
+	items map[string]string
+	files map[string][]byte
+	watch *Watch
+}
+
+func newAppConfig(watch *Watch) *AppConfig {
+	return &AppConfig{
+		items: make(map[string]string),
+		files: make(map[string][]byte),
+		watch: watch,
+	}
+}
+
+func NewServer() *Server {
+	s := &Server{
+		AppConfig: newAppConfig(NewWatch()),
+		apps:      make(map[string]*AppConfig),
+		admin:     newAdminState(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(disconf.DISCONF_ZOO_HOSTS_ACTION, s.handleZooHosts)
+	mux.HandleFunc(disconf.DISCONF_STORE_ACTION, s.handleList)
+	mux.HandleFunc(disconf.DISCONF_ITEM_ACTION, s.handleItem)
+	mux.HandleFunc(disconf.DISCONF_FILE_ACTION, s.handleFile)
+	s.handleAdmin(mux)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// app/version/env 单独的配置, 用于测试 disconf.WithSubscription
+func (s *Server) App(app, version, env string) *AppConfig {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name := disconf.SubscriptionName(app, version, env)
+	a, ok := s.apps[name]
+	if !ok {
+		a = newAppConfig(s.AppConfig.watch.App(app, version, env))
+		s.apps[name] = a
+		s.admin.register(app, version, env)
+	}
+	return a
+}
+
+// 按请求参数选择配置
+func (s *Server) app(r *http.Request) *AppConfig {
+	q := r.URL.Query()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if a, ok := s.apps[disconf.SubscriptionName(q.Get("app"), q.Get("version"), q.Get("env"))]; ok {
+		return a
+	}
+	return s.AppConfig
+}
+
+// 与服务端数据联动的 watch, 通过 disconf.WithWatcher 传给客户端
+func (a *AppConfig) Watch() *Watch {
+	return a.watch
+}
+
+// 设置配置项, 不通知客户端
+func (a *AppConfig) SetItem(key, value string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.items[key] = value
+}
+
+// 设置配置文件, 不通知客户端
+func (a *AppConfig) SetFile(name string, content []byte) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.files[name] = content
+}
+
+// 更新配置项并触发变化通知, 返回变化后的节点版本
+func (a *AppConfig) UpdateItem(key, value string) int32 {
+	a.SetItem(key, value)
+	return a.watch.Notify(key, disconf.DISCONF_TYPE_ITEM)
+}
+
+// 更新配置文件并触发变化通知, 返回变化后的节点版本
+func (a *AppConfig) UpdateFile(name string, content []byte) int32 {
+	a.SetFile(name, content)
+	return a.watch.Notify(name, disconf.DISCONF_TYPE_FILE)
+}
+
+func (s *Server) handleZooHosts(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, map[string]interface{}{
+		"status": disconf.ZOO_SUCCESS_STATUS,
+		"value":  FAKE_ZK_HOSTS,
+	})
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	a := s.app(r)
+	a.mutex.Lock()
+	results := []*disconf.Result{}
+	for _, key := range sortedKeys(a.items) {
+		results = append(results, &disconf.Result{
+			Id:      s.configId(a, disconf.DISCONF_TYPE_ITEM, key),
+			Genre:   disconf.DISCONF_TYPE_ITEM,
+			Name:    key,
+			Value:   a.items[key],
+			Version: q.Get("version"),
+		})
+	}
+	names := make([]string, 0, len(a.files))
+	for name := range a.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		results = append(results, &disconf.Result{
+			Id:      s.configId(a, disconf.DISCONF_TYPE_FILE, name),
+			Genre:   disconf.DISCONF_TYPE_FILE,
+			Name:    name,
+			Value:   string(a.files[name]),
+			Version: q.Get("version"),
+		})
+	}
+	a.mutex.Unlock()
+	resp := map[string]interface{}{
+		"success": disconf.STRING_TRUE,
+		"page":    map[string]interface{}{"result": results},
+	}
+	writeJson(w, resp)
+}
+
+func (s *Server) handleItem(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	a := s.app(r)
+	a.mutex.Lock()
+	value, ok := a.items[key]
+	a.mutex.Unlock()
+	if !ok {
+		http.Error(w, "item not found", http.StatusNotFound)
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"status": disconf.ZOO_SUCCESS_STATUS,
+		"value":  value,
+	})
+}
+
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	a := s.app(r)
+	a.mutex.Lock()
+	content, ok := a.files[key]
+	a.mutex.Unlock()
+	if !ok {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	w.Write(content)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,264 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconftest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+)
+
+// 内存中的 disconf.IWatch 实现, 通过 Notify 触发变化通知
+type Watch struct {
+	*watchState
+	// Subscribe 订阅的 <app>_<version>_<env>, 客户端自身的为空
+	app string
+}
+
+// 同一个 Watch 的所有订阅共享
+type watchState struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	nodes     map[string][]byte
+	versions  map[string]int32
+	notified  map[string]int32
+	watchers  map[string][]chan int32
+	instances map[string][]byte
+	hostPath  string
+}
+
+func NewWatch() *Watch {
+	state := &watchState{
+		nodes:     make(map[string][]byte),
+		versions:  make(map[string]int32),
+		notified:  make(map[string]int32),
+		watchers:  make(map[string][]chan int32),
+		instances: make(map[string][]byte),
+		hostPath:  "/127.0.0.1_8080_disconftest",
+	}
+	state.cond = sync.NewCond(&state.mutex)
+	return &Watch{watchState: state}
+}
+
+func (w *Watch) Subscribe(app, version, env string) disconf.IWatch {
+	return w.App(app, version, env)
+}
+
+// 订阅 app/version/env 的 watch, 与 w 共享节点
+func (w *Watch) App(app, version, env string) *Watch {
+	return &Watch{watchState: w.watchState, app: disconf.SubscriptionName(app, version, env)}
+}
+
+func (w *Watch) InitZk() error {
+	return nil
+}
+
+func (w *Watch) WatchPath(key string, disconfType int, respChan chan disconf.WatchResponse) {
+	path, err := w.GetBaseUrl(key, disconfType)
+	if err != nil {
+		respChan <- disconf.WatchResponse{Err: err, DisconfType: disconfType, Key: key}
+		return
+	}
+	ch := make(chan int32, 1)
+	w.mutex.Lock()
+	// 注册 watch 之前发生的变化立即通知, 避免丢失
+	if w.versions[path] > w.notified[path] {
+		w.notified[path] = w.versions[path]
+		ch <- w.versions[path]
+	} else {
+		w.watchers[path] = append(w.watchers[path], ch)
+	}
+	w.mutex.Unlock()
+	version := <-ch
+	respChan <- disconf.WatchResponse{DisconfType: disconfType, Key: key, Version: version}
+}
+
+// 触发 key 的变化通知, 返回变化后的节点版本
+func (w *Watch) Notify(key string, disconfType int) int32 {
+	path, err := w.GetBaseUrl(key, disconfType)
+	if err != nil {
+		panic(err)
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.versions[path]++
+	version := w.versions[path]
+	if len(w.watchers[path]) > 0 {
+		w.notified[path] = version
+	}
+	for _, ch := range w.watchers[path] {
+		ch <- version
+	}
+	delete(w.watchers, path)
+	return version
+}
+
+func (w *Watch) CreateZkPath(path string, zkFlag int32, value []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.nodes[path]; !ok || value != nil {
+		w.nodes[path] = value
+	}
+	w.cond.Broadcast()
+	return nil
+}
+
+func (w *Watch) GetBaseUrl(key string, disconfType int) (string, error) {
+	base := "/disconf/"
+	if w.app != disconf.EMPTY_STRING {
+		base += w.app + "/"
+	}
+	switch disconfType {
+	case disconf.DISCONF_TYPE_FILE:
+		return base + "file/" + key, nil
+	case disconf.DISCONF_TYPE_ITEM:
+		return base + "item/" + key, nil
+	}
+	return disconf.EMPTY_STRING, fmt.Errorf("disconf type err")
+}
+
+func (w *Watch) CreateZkDir(disconfType int, key string) error {
+	path, err := w.GetBaseUrl(key, disconfType)
+	if err != nil {
+		return err
+	}
+	return w.CreateZkPath(path, 0, nil)
+}
+
+func (w *Watch) GetLocalHostPath() (string, error) {
+	return w.hostPath, nil
+}
+
+func (w *Watch) SetZkValue(path string, value []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.nodes[path] = value
+	w.cond.Broadcast()
+	return nil
+}
+
+func (w *Watch) RegisterInstance(value []byte) error {
+	return w.UpdateInstance(value)
+}
+
+func (w *Watch) UpdateInstance(value []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.instances[w.app] = value
+	w.cond.Broadcast()
+	return nil
+}
+
+func (w *Watch) GetZkVersion(path string) (int32, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.versions[path], nil
+}
+
+func (w *Watch) SessionState() (bool, int64) {
+	return true, 1
+}
+
+// 实例在 key 节点下上报的值
+func (w *Watch) Value(key string, disconfType int) ([]byte, bool) {
+	path, err := w.GetBaseUrl(key, disconfType)
+	if err != nil {
+		return nil, false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	value, ok := w.nodes[path+w.hostPath]
+	return value, ok
+}
+
+// zk 节点的值, 如 Admin.Notify 写入 key 节点的值
+func (w *Watch) Node(path string) ([]byte, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	value, ok := w.nodes[path]
+	return value, ok
+}
+
+// 各实例在 key 节点下上报的值, 与 disconf.Watch 的 KeyInstances 相同
+func (w *Watch) KeyInstances(key string, disconfType int) (map[string][]byte, error) {
+	path, err := w.GetBaseUrl(key, disconfType)
+	if err != nil {
+		return nil, err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	instances := make(map[string][]byte)
+	for node, value := range w.nodes {
+		if child := strings.TrimPrefix(node, path+"/"); child != node && !strings.Contains(child, "/") {
+			instances[child] = value
+		}
+	}
+	return instances, nil
+}
+
+func (w *Watch) Close() {
+}
+
+// 实例节点中上报的应用状态
+func (w *Watch) InstanceStatus() (*disconf.InstanceStatus, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.instanceStatus()
+}
+
+func (w *Watch) instanceStatus() (*disconf.InstanceStatus, error) {
+	instance, ok := w.instances[w.app]
+	if !ok {
+		return nil, fmt.Errorf("instance not registered")
+	}
+	status := &disconf.InstanceStatus{}
+	if err := json.Unmarshal(instance, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// 等待客户端上报 key 已应用到 version 版本, 用于确定性地测试热加载
+func (w *Watch) WaitApplied(key string, version int32, timeout time.Duration) (*disconf.KeyStatus, error) {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		w.mutex.Lock()
+		w.cond.Broadcast()
+		w.mutex.Unlock()
+	})
+	defer timer.Stop()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for {
+		if status, err := w.instanceStatus(); err == nil {
+			if keyStatus, ok := status.Keys[key]; ok && keyStatus.Version >= version {
+				return keyStatus, nil
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("wait applied timeout [key:%v] [version:%v]", key, version)
+		}
+		w.cond.Wait()
+	}
+}
+
+// 当前的 zk 节点, 便于断言
+func (w *Watch) Paths(prefix string) []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	paths := []string{}
+	for path := range w.nodes {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,158 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 热加载时原子更新的字段类型, 可以在其他 goroutine 中安全读取:
+//
+//	type Conf struct {
+//		Timeout disconf.Duration `conf:"timeout"`
+//	}
+//	conf.Timeout.Load()
+//
+// 不需要 auto:"true" 标签也会热加载, T 支持的类型与 Get[T] 相同
+type Value[T any] struct {
+	value       atomic.Pointer[T]
+	mutex       sync.Mutex
+	subscribers map[int]func(old, new T)
+	nextId      int
+}
+
+type (
+	String   = Value[string]
+	Int64    = Value[int64]
+	Int      = Value[int]
+	Float64  = Value[float64]
+	Bool     = Value[bool]
+	Duration = Value[time.Duration]
+)
+
+// Store 识别的字段类型
+type dynamicField interface {
+	// 设置新值, 值变化时返回的 notify 需要在 Store 释放锁之后调用
+	set(value string) (notify func(), err error)
+
+	String() string
+}
+
+func (v *Value[T]) Load() T {
+	if p := v.value.Load(); p != nil {
+		return *p
+	}
+	var zero T
+	return zero
+}
+
+// 设置默认值, 之后加载到的配置会覆盖
+func (v *Value[T]) Store(x T) {
+	v.value.Store(&x)
+}
+
+// 值变化时在热加载的 goroutine 中调用 fn, 返回的函数用于取消订阅
+func (v *Value[T]) OnChange(fn func(old, new T)) (cancel func()) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.subscribers == nil {
+		v.subscribers = make(map[int]func(old, new T))
+	}
+	id := v.nextId
+	v.nextId++
+	v.subscribers[id] = fn
+	return func() {
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		delete(v.subscribers, id)
+	}
+}
+
+func (v *Value[T]) String() string {
+	return fmt.Sprint(v.Load())
+}
+
+func (v *Value[T]) set(value string) (func(), error) {
+	var zero T
+	converted, err := convertValue(value, reflect.TypeOf(zero))
+	if err != nil {
+		return nil, err
+	}
+	x := converted.(T)
+	old := v.value.Swap(&x)
+	if old != nil && reflect.DeepEqual(*old, x) {
+		return nil, nil
+	}
+	oldValue := zero
+	if old != nil {
+		oldValue = *old
+	}
+	v.mutex.Lock()
+	subscribers := make([]func(old, new T), 0, len(v.subscribers))
+	for _, fn := range v.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	v.mutex.Unlock()
+	if len(subscribers) == 0 {
+		return nil, nil
+	}
+	return func() {
+		for _, fn := range subscribers {
+			fn(oldValue, x)
+		}
+	}, nil
+}
+
+// 字段为 Value[T] 或 *Value[T] 时返回, nil 指针已在绑定时由 allocDynamicFields 分配
+func dynamicFieldOf(field reflect.Value) (dynamicField, bool) {
+	if field.Kind() == reflect.Ptr {
+		if _, ok := reflect.Zero(field.Type()).Interface().(dynamicField); !ok || field.IsNil() {
+			return nil, false
+		}
+		return field.Interface().(dynamicField), true
+	}
+	if !field.CanAddr() {
+		return nil, false
+	}
+	d, ok := field.Addr().Interface().(dynamicField)
+	return d, ok
+}
+
+// 绑定时分配为 nil 的 *Value[T] 字段, key 不存在时 Load() 不会 panic,
+// 热加载的 goroutine 也不需要修改结构体中的指针
+func allocDynamicFields(conf interface{}) {
+	elems := reflect.TypeOf(conf).Elem()
+	values := reflect.ValueOf(conf).Elem()
+	for i := 0; i < elems.NumField(); i++ {
+		field := values.Field(i)
+		if elems.Field(i).Tag.Get(CONF_TAG) == EMPTY_STRING || field.Kind() != reflect.Ptr || !field.IsNil() ||
+			!field.CanSet() || !isDynamicType(field.Type()) {
+			continue
+		}
+		field.Set(reflect.New(field.Type().Elem()))
+	}
+}
+
+func isDynamicType(typ reflect.Type) bool {
+	dynamicType := reflect.TypeOf((*dynamicField)(nil)).Elem()
+	return typ.Implements(dynamicType) || reflect.PtrTo(typ).Implements(dynamicType)
+}
+
+// 在释放 mutex 之后调用字段的变化通知, 回调中可以读取配置
+func (s *Store) notify() {
+	s.mutex.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mutex.Unlock()
+	for _, fn := range pending {
+		fn()
+	}
+}
@@ -0,0 +1,212 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 功能开关, 配置项的值可以是:
+//
+//	on / off (也支持 true/false、1/0)
+//	20%      按用户 id 灰度 20%
+//	{"enabled": true, "percentage": 20, "users": ["u1"], "instances": ["10.0.0.1:8080", "web-*"], "ips": ["10.0.1.0/24"]}
+//
+// enabled 为 false 时对所有用户关闭; users 中的用户和 instances、ips 匹配的实例是白名单, 总是打开;
+// 其他用户按 percentage 以 开关名+用户 id 的哈希稳定分桶, 没有用户 id 时使用实例的 host:port
+// (设置了 WithInstanceId 时为实例 id), 重启后分桶不变. json 中没有 percentage 时,
+// 设置了白名单则为 0 (只对白名单打开), 否则为 100
+type FeatureFlag struct {
+	Enabled    bool     `json:"enabled"`
+	Percentage float64  `json:"percentage"`
+	Users      []string `json:"users,omitempty"`
+	// 匹配实例的 host、host:port 或实例 id, 支持通配符
+	Instances []string `json:"instances,omitempty"`
+	// 匹配实例的 ip 或网段
+	Ips []string `json:"ips,omitempty"`
+}
+
+// 判断开关时的上下文
+type FlagContext struct {
+	// 用于白名单和按比例灰度, 为空时按实例 id 灰度
+	UserId string
+}
+
+const (
+	FLAG_PERCENT     = "%"
+	FLAG_BUCKETS     = 10000
+	FLAG_PERCENT_MAX = 100
+)
+
+// 已解析的开关, 配置项的值变化后重新解析
+type parsedFlag struct {
+	raw  string
+	flag *FeatureFlag
+	err  error
+}
+
+type flagCache struct {
+	mutex sync.Mutex
+	flags map[string]parsedFlag
+}
+
+func ParseFeatureFlag(value string) (*FeatureFlag, error) {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(value) {
+	case "on", "true", "1", "yes":
+		return &FeatureFlag{Enabled: true, Percentage: FLAG_PERCENT_MAX}, nil
+	case "off", "false", "0", "no", EMPTY_STRING:
+		return &FeatureFlag{}, nil
+	}
+	if strings.HasSuffix(value, FLAG_PERCENT) {
+		percentage, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, FLAG_PERCENT)), 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse percentage [value:%v] [err:%v]", value, err)
+		}
+		return checkFlag(&FeatureFlag{Enabled: true, Percentage: percentage})
+	}
+	if strings.HasPrefix(value, "{") {
+		var raw struct {
+			Enabled    *bool    `json:"enabled"`
+			Percentage *float64 `json:"percentage"`
+			Users      []string `json:"users"`
+			Instances  []string `json:"instances"`
+			Ips        []string `json:"ips"`
+		}
+		if err := json.Unmarshal([]byte(value), &raw); err != nil {
+			return nil, fmt.Errorf("parse flag json [err:%v]", err)
+		}
+		flag := &FeatureFlag{Enabled: true, Percentage: FLAG_PERCENT_MAX, Users: raw.Users, Instances: raw.Instances, Ips: raw.Ips}
+		if flag.allowlisted() {
+			flag.Percentage = 0
+		}
+		if raw.Enabled != nil {
+			flag.Enabled = *raw.Enabled
+		}
+		if raw.Percentage != nil {
+			flag.Percentage = *raw.Percentage
+		}
+		return checkFlag(flag)
+	}
+	return nil, fmt.Errorf("unknown flag value [value:%v]", value)
+}
+
+func checkFlag(flag *FeatureFlag) (*FeatureFlag, error) {
+	if flag.Percentage < 0 || flag.Percentage > FLAG_PERCENT_MAX {
+		return nil, fmt.Errorf("percentage out of range [percentage:%v]", flag.Percentage)
+	}
+	for _, ip := range flag.Ips {
+		if net.ParseIP(ip) == nil {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				return nil, fmt.Errorf("parse ip [ip:%v] [err:%v]", ip, err)
+			}
+		}
+	}
+	return flag, nil
+}
+
+func (f *FeatureFlag) allowlisted() bool {
+	return len(f.Users) > 0 || len(f.Instances) > 0 || len(f.Ips) > 0
+}
+
+// 在 identity 对应的实例上对 fc 是否打开, name 用于分桶
+func (f *FeatureFlag) Evaluate(name string, fc FlagContext, identity *Identity) bool {
+	if !f.Enabled {
+		return false
+	}
+	for _, user := range f.Users {
+		if fc.UserId != EMPTY_STRING && user == fc.UserId {
+			return true
+		}
+	}
+	if f.matchInstance(identity) {
+		return true
+	}
+	if f.Percentage >= FLAG_PERCENT_MAX {
+		return true
+	}
+	id := fc.UserId
+	if id == EMPTY_STRING && identity != nil {
+		id = identity.bucketKey()
+	}
+	return float64(flagBucket(name, id)) < f.Percentage*FLAG_BUCKETS/FLAG_PERCENT_MAX
+}
+
+func (f *FeatureFlag) matchInstance(identity *Identity) bool {
+	if identity == nil {
+		return false
+	}
+	candidates := []string{identity.Host, identity.Host + ":" + identity.Port, identity.Id}
+	for _, pattern := range f.Instances {
+		for _, candidate := range candidates {
+			if ok, _ := path.Match(pattern, candidate); ok {
+				return true
+			}
+		}
+	}
+	ip := net.ParseIP(identity.Host)
+	if ip == nil {
+		return false
+	}
+	for _, s := range f.Ips {
+		if other := net.ParseIP(s); other != nil && other.Equal(ip) {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(s); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 同一个开关和 id 总是落在同一个桶, 不同开关之间相互独立
+func flagBucket(name, id string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + id))
+	return h.Sum32() % FLAG_BUCKETS
+}
+
+// 开关 name 对应配置项当前的值, 配置项热加载后立即生效
+func (c *Client) FeatureFlag(name string) (*FeatureFlag, error) {
+	value, ok, err := c.store.value(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("flag not found [name:%v]", name)
+	}
+	c.flags.mutex.Lock()
+	defer c.flags.mutex.Unlock()
+	if c.flags.flags == nil {
+		c.flags.flags = make(map[string]parsedFlag)
+	}
+	if parsed, ok := c.flags.flags[name]; ok && parsed.raw == value {
+		return parsed.flag, parsed.err
+	}
+	flag, err := ParseFeatureFlag(value)
+	if err != nil {
+		c.logger.Warn("parse feature flag", F(LOG_FIELD_KEY, name), F(LOG_FIELD_ERR, err))
+	}
+	c.flags.flags[name] = parsedFlag{raw: value, flag: flag, err: err}
+	return flag, err
+}
+
+// 开关是否对 fc 打开, 开关不存在或格式错误时关闭
+func (c *Client) Enabled(name string, fc FlagContext) bool {
+	flag, err := c.FeatureFlag(name)
+	if err != nil {
+		return false
+	}
+	return flag.Evaluate(name, fc, c.identity)
+}
@@ -7,6 +7,7 @@
 package disconf_client
 
 import (
+	"context"
 	"github.com/parnurzeal/gorequest"
 	"time"
 	"os"
@@ -16,15 +17,20 @@ import (
 	"net/http"
 )
 
+// 从 disconf 服务端获取配置, 可通过 WithFetcher 替换默认实现
+// suffixUrl 形如 ?app=%v&env=%v&version=%v&key=%v
+// ctx 用于传递 trace context
 type IFetcher interface {
-	getValue(suffixUrl string) (string, []error)
+	GetValue(ctx context.Context, suffixUrl string) (string, []error)
 
-	downloadFile(suffixUrl, fileName string) []error
+	// 配置文件的内容, 由客户端掩码敏感值后写入 WithDownloadDir 指定的目录
+	GetFile(ctx context.Context, suffixUrl string) ([]byte, []error)
 
-	getAllConf(suffixUrl string) ([]*Result, []error)
+	GetAllConf(ctx context.Context, suffixUrl string) ([]*Result, []error)
 
-	getZkHost() (string, []error)
+	GetZkHost(ctx context.Context) (string, []error)
 }
+
 type Fetcher struct {
 	//文件下载目录
 	downloadDir string
@@ -37,6 +43,20 @@ type Fetcher struct {
 
 	// host List
 	hostList []string
+
+	// 请求指标
+	metrics MetricsCollector
+
+	logger Logger
+
+	tracer Tracer
+
+	// FetchAll 解析 properties 文件时的编码
+	charset      string
+	fileCharsets map[string]string
+
+	// 所有请求共用, 保持长连接, 同一个客户端的订阅和 Admin 复用连接
+	transport *http.Transport
 }
 
 type zooHostsResp struct {
@@ -74,6 +94,8 @@ const (
 	DISCONF_ZOO_HOSTS_ACTION = "/api/zoo/hosts"
 	STRING_TRUE              = "true"
 	ZOO_SUCCESS_STATUS       = 1
+	// 空闲连接保持的时间
+	HTTP_IDLE_CONN_TIMEOUT = 90 * time.Second
 )
 
 type itemResp struct {
@@ -82,14 +104,40 @@ type itemResp struct {
 	Value   string `json:"value"`
 }
 
-func (f Fetcher) getValue(suffixUrl string) (string, []error) {
+// 不创建 Client 时使用, 如命令行工具. 支持 WithRetryTimes、WithRetrySleepSeconds、WithDownloadDir、
+// WithMetrics、WithLogger、WithTracer、WithCharset 和 WithFileCharset
+func NewFetcher(serverHost string, opts ...ClientOption) (*Fetcher, error) {
+	c := newOptions(opts)
+	if err := checkCharsets(c.charset, c.fileCharsets); err != nil {
+		return nil, err
+	}
+	return newFetcher(serverHost, c, c.metrics, c.logger), nil
+}
+
+func newFetcher(serverHost string, c *Client, metrics MetricsCollector, logger Logger) *Fetcher {
+	return &Fetcher{
+		retryTime:         c.retryTimes,
+		retrySleepSeconds: c.retrySleepSeconds,
+		downloadDir:       c.downloadDir,
+		hostList:          strings.Split(serverHost, COMMA_SPLIT),
+		metrics:           metrics,
+		logger:            logger,
+		tracer:            c.tracer,
+		charset:           c.charset,
+		fileCharsets:      c.fileCharsets,
+		transport:         &http.Transport{IdleConnTimeout: HTTP_IDLE_CONN_TIMEOUT},
+	}
+}
+
+func (f Fetcher) GetValue(ctx context.Context, suffixUrl string) (string, []error) {
 	urls := f.getUrls(DISCONF_ITEM_ACTION + suffixUrl)
 	var resp itemResp
 	errs := []error{}
-	for _, url := range urls {
-		_, _, httpErrs := gorequest.New().Get(url).
-			Retry(f.retryTime, time.Duration(f.retrySleepSeconds)*time.Second, http.StatusBadRequest, http.StatusInternalServerError).
-			EndStruct(&resp)
+	for i, url := range urls {
+		start := time.Now()
+		reqCtx, span := f.startSpan(ctx, DISCONF_ITEM_ACTION, i)
+		_, _, httpErrs := f.newRequest(reqCtx, url).EndStruct(&resp)
+		f.observe(span, DISCONF_ITEM_ACTION, i, start, httpErrs)
 		if len(httpErrs) <= 0 {
 			return resp.Value, nil
 		}
@@ -98,7 +146,8 @@ func (f Fetcher) getValue(suffixUrl string) (string, []error) {
 	return EMPTY_STRING, errs
 }
 
-func (f Fetcher) downloadFile(suffixUrl, fileName string) []error {
+// 下载文件到 WithDownloadDir 指定的目录, 不掩码敏感值, 用于命令行工具
+func (f Fetcher) DownloadFile(ctx context.Context, suffixUrl, fileName string) []error {
 	errs := []error{}
 	_, err := os.Stat(f.downloadDir)
 	if err != nil {
@@ -107,63 +156,77 @@ func (f Fetcher) downloadFile(suffixUrl, fileName string) []error {
 			return append(errs, err)
 		}
 	}
-	bodyBytes, errs := f.httpEndByte(DISCONF_FILE_ACTION + suffixUrl)
+	bodyBytes, errs := f.httpEndByte(ctx, DISCONF_FILE_ACTION, suffixUrl)
 	if len(errs) > 0 {
 		return errs
 	}
-	if err = ioutil.WriteFile(f.downloadDir+fileName, bodyBytes, os.ModeAppend); err != nil {
+	if err = ioutil.WriteFile(f.downloadDir+fileName, bodyBytes, 0644); err != nil {
 		return append(errs, err)
 	}
 	return nil
 }
 
-func (f Fetcher) getAllConf(suffixUrl string) ([]*Result, []error) {
+// 配置文件的内容, 不写入下载目录
+func (f Fetcher) GetFile(ctx context.Context, suffixUrl string) ([]byte, []error) {
+	return f.httpEndByte(ctx, DISCONF_FILE_ACTION, suffixUrl)
+}
+
+func (f Fetcher) GetAllConf(ctx context.Context, suffixUrl string) ([]*Result, []error) {
 	urls := f.getUrls(DISCONF_STORE_ACTION + suffixUrl)
 	var resp confListResp
 	errs := []error{}
-	for _, url := range urls {
-		_, _, httpErrs := gorequest.New().Get(url).
-			Retry(f.retryTime, time.Duration(f.retrySleepSeconds)*time.Second, http.StatusBadRequest, http.StatusInternalServerError).
-			EndStruct(&resp)
+	for i, url := range urls {
+		start := time.Now()
+		reqCtx, span := f.startSpan(ctx, DISCONF_STORE_ACTION, i)
+		_, _, httpErrs := f.newRequest(reqCtx, url).EndStruct(&resp)
 		if len(httpErrs) <= 0 {
 			if resp.Success != STRING_TRUE {
-				errs = append(errs, fmt.Errorf("get all conf %v", resp.Message))
+				err := fmt.Errorf("get all conf %v", resp.Message)
+				f.observe(span, DISCONF_STORE_ACTION, i, start, []error{err})
+				errs = append(errs, err)
 				continue
 			}
+			f.observe(span, DISCONF_STORE_ACTION, i, start, nil)
 			return resp.Page.Results, nil
 		}
+		f.observe(span, DISCONF_STORE_ACTION, i, start, httpErrs)
 		errs = append(errs, httpErrs...)
 	}
 	return nil, errs
 }
 
-func (f Fetcher) getZkHost() (string, []error) {
+func (f Fetcher) GetZkHost(ctx context.Context) (string, []error) {
 	urls := f.getUrls(DISCONF_ZOO_HOSTS_ACTION)
 	var resp zooHostsResp
 	errs := []error{}
-	for _, url := range urls {
-		_, _, httpErrs := gorequest.New().Get(url).
-			Retry(f.retryTime, time.Duration(f.retrySleepSeconds)*time.Second, http.StatusBadRequest, http.StatusInternalServerError).
-			EndStruct(&resp)
+	for i, url := range urls {
+		start := time.Now()
+		reqCtx, span := f.startSpan(ctx, DISCONF_ZOO_HOSTS_ACTION, i)
+		_, _, httpErrs := f.newRequest(reqCtx, url).EndStruct(&resp)
 		if len(httpErrs) <= 0 {
 			if resp.Status != ZOO_SUCCESS_STATUS {
-				errs = append(errs, fmt.Errorf("get zoo hosts [err:%v]", resp.Message))
+				err := fmt.Errorf("get zoo hosts [err:%v]", resp.Message)
+				f.observe(span, DISCONF_ZOO_HOSTS_ACTION, i, start, []error{err})
+				errs = append(errs, err)
 				continue
 			}
+			f.observe(span, DISCONF_ZOO_HOSTS_ACTION, i, start, nil)
 			return resp.Value, nil
 		}
+		f.observe(span, DISCONF_ZOO_HOSTS_ACTION, i, start, httpErrs)
 		errs = append(errs, httpErrs...)
 	}
 	return EMPTY_STRING, errs
 }
 
-func (f Fetcher) httpEndByte(suffixUrl string) ([]byte, []error) {
+func (f Fetcher) httpEndByte(ctx context.Context, action, suffixUrl string) ([]byte, []error) {
 	errs := []error{}
-	urls := f.getUrls(suffixUrl)
-	for _, url := range urls {
-		_, bodyBytes, httpErrs := gorequest.New().Get(url).
-			Retry(f.retryTime, time.Duration(f.retrySleepSeconds)*time.Second, http.StatusBadRequest, http.StatusInternalServerError).
-			EndBytes()
+	urls := f.getUrls(action + suffixUrl)
+	for i, url := range urls {
+		start := time.Now()
+		reqCtx, span := f.startSpan(ctx, action, i)
+		_, bodyBytes, httpErrs := f.newRequest(reqCtx, url).EndBytes()
+		f.observe(span, action, i, start, httpErrs)
 		if len(httpErrs) <= 0 {
 			return bodyBytes, nil
 		}
@@ -172,6 +235,54 @@ func (f Fetcher) httpEndByte(suffixUrl string) ([]byte, []error) {
 	return nil, errs
 }
 
+func (f Fetcher) newRequest(ctx context.Context, url string) *gorequest.SuperAgent {
+	return f.newMethodRequest(ctx, gorequest.GET, url)
+}
+
+// 只有 GET 按 WithRetryTimes 重试, 写操作不是幂等的, 服务端已执行后重试会重复写入
+func (f Fetcher) newMethodRequest(ctx context.Context, method, url string) *gorequest.SuperAgent {
+	req := gorequest.New().CustomMethod(method, url)
+	// gorequest 默认每个请求新建关闭了长连接的 Transport
+	if f.transport != nil {
+		req.Transport = f.transport
+	}
+	if method == gorequest.GET {
+		req = req.Retry(f.retryTime, time.Duration(f.retrySleepSeconds)*time.Second, http.StatusBadRequest, http.StatusInternalServerError)
+	}
+	if f.tracer != nil {
+		header := http.Header{}
+		f.tracer.Inject(ctx, header)
+		for k := range header {
+			req.Set(k, header.Get(k))
+		}
+	}
+	return req
+}
+
+func (f Fetcher) startSpan(ctx context.Context, endpoint string, hostIndex int) (context.Context, Span) {
+	if f.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return f.tracer.Start(ctx, SPAN_FETCH, F(LOG_FIELD_ENDPOINT, endpoint), F(LOG_FIELD_HOST, f.hostList[hostIndex]),
+		F(LOG_FIELD_ATTEMPT, hostIndex+1))
+}
+
+func (f Fetcher) observe(span Span, endpoint string, hostIndex int, start time.Time, errs []error) {
+	var err error
+	if len(errs) > 0 {
+		err = errs[0]
+	}
+	endSpan(span, err)
+	if err != nil && f.logger != nil {
+		f.logger.Warn("fetch from host", F(LOG_FIELD_ENDPOINT, endpoint), F(LOG_FIELD_HOST, f.hostList[hostIndex]),
+			F(LOG_FIELD_ATTEMPT, hostIndex+1), F(LOG_FIELD_ERR, err))
+	}
+	if f.metrics == nil {
+		return
+	}
+	f.metrics.ObserveFetch(endpoint, f.hostList[hostIndex], time.Since(start), err)
+}
+
 func (f Fetcher) getUrls(suffixUrl string) []string {
 	urls := []string{}
 	for _, host := range f.hostList {
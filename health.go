@@ -0,0 +1,227 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 客户端健康状态, 用于 k8s 的 liveness/readiness 探针
+type HealthStatus struct {
+	// 初始加载已完成
+	Ready bool `json:"ready"`
+
+	// remote: 从服务端加载并热更新, local: 只加载本地文件
+	Mode string `json:"mode"`
+
+	// zk 断开、最近一次请求服务端失败或有 key 最近一次热加载失败
+	Degraded bool `json:"degraded"`
+
+	ZkConnected bool  `json:"zkConnected"`
+	ZkSessionId int64 `json:"zkSessionId"`
+
+	ServerReachable bool      `json:"serverReachable"`
+	ServerCheckedAt time.Time `json:"serverCheckedAt,omitempty"`
+	ServerError     string    `json:"serverError,omitempty"`
+
+	Keys map[string]KeyHealth `json:"keys"`
+}
+
+type KeyHealth struct {
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	LastFailure time.Time `json:"lastFailure,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+const (
+	MODE_REMOTE = "remote"
+	MODE_LOCAL  = "local"
+)
+
+// 客户端的健康状态, 通过 MetricsCollector 收集
+// 可以在 NewClient 之前用 NewHealth 创建并通过 WithHealth 传入, 初始加载完成前探针即可返回 503;
+// 一个 Health 只用于一个客户端
+type Health struct {
+	mutex           sync.Mutex
+	ready           bool
+	enableRemote    bool
+	watch           IWatch
+	serverCheckedAt time.Time
+	serverError     error
+	keys            map[string]*KeyHealth
+}
+
+func NewHealth() *Health {
+	return &Health{keys: make(map[string]*KeyHealth)}
+}
+
+// 使用外部创建的 Health, 不设置时由 NewClient 创建
+func WithHealth(health *Health) ClientOption {
+	return func(c *Client) {
+		c.health = health
+	}
+}
+
+// NewClient 创建 watch 后、初始加载前调用
+func (h *Health) attach(enableRemote bool, watch IWatch) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.enableRemote = enableRemote
+	h.watch = watch
+}
+
+func (h *Health) setReady() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.ready = true
+}
+
+func (h *Health) key(key string) *KeyHealth {
+	k, ok := h.keys[key]
+	if !ok {
+		k = &KeyHealth{}
+		h.keys[key] = k
+	}
+	return k
+}
+
+func (h *Health) ObserveFetch(endpoint, host string, duration time.Duration, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.serverCheckedAt = time.Now()
+	h.serverError = err
+}
+
+func (h *Health) ObserveReload(key string, disconfType int, err error) {
+	if err == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	k := h.key(key)
+	k.LastFailure = time.Now()
+	k.LastError = err.Error()
+}
+
+func (h *Health) ObserveConversionError(key string) {}
+
+func (h *Health) SetZkConnected(connected bool) {}
+
+func (h *Health) SetConfigUpdated(key string, t time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	k := h.key(key)
+	k.LastSuccess = t
+	k.LastError = EMPTY_STRING
+}
+
+// 依次调用多个 MetricsCollector
+type multiMetrics []MetricsCollector
+
+func (m multiMetrics) ObserveFetch(endpoint, host string, duration time.Duration, err error) {
+	for _, c := range m {
+		c.ObserveFetch(endpoint, host, duration, err)
+	}
+}
+
+func (m multiMetrics) ObserveReload(key string, disconfType int, err error) {
+	for _, c := range m {
+		c.ObserveReload(key, disconfType, err)
+	}
+}
+
+func (m multiMetrics) ObserveConversionError(key string) {
+	for _, c := range m {
+		c.ObserveConversionError(key)
+	}
+}
+
+func (m multiMetrics) SetZkConnected(connected bool) {
+	for _, c := range m {
+		c.SetZkConnected(connected)
+	}
+}
+
+func (m multiMetrics) SetConfigUpdated(key string, t time.Time) {
+	for _, c := range m {
+		c.SetConfigUpdated(key, t)
+	}
+}
+
+func (h *Health) Status() HealthStatus {
+	h.mutex.Lock()
+	status := HealthStatus{
+		Ready:           h.ready,
+		Mode:            MODE_LOCAL,
+		ServerCheckedAt: h.serverCheckedAt,
+		ServerReachable: !h.serverCheckedAt.IsZero() && h.serverError == nil,
+		Keys:            make(map[string]KeyHealth),
+	}
+	if h.enableRemote {
+		status.Mode = MODE_REMOTE
+	}
+	if h.serverError != nil {
+		status.ServerError = h.serverError.Error()
+	}
+	failed := false
+	for key, k := range h.keys {
+		status.Keys[key] = *k
+		if k.LastError != EMPTY_STRING {
+			failed = true
+		}
+	}
+	enableRemote, watch := h.enableRemote, h.watch
+	h.mutex.Unlock()
+	if watch != nil {
+		status.ZkConnected, status.ZkSessionId = watch.SessionState()
+	}
+	if enableRemote {
+		status.Degraded = !status.ZkConnected || !status.ServerReachable || failed
+	}
+	return status
+}
+
+// readiness 探针: 初始加载完成前返回 503
+func (h *Health) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := h.Status()
+		code := http.StatusOK
+		if !status.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, status)
+	})
+}
+
+// liveness 探针: 降级时仍返回 200, 避免 zk 或服务端故障导致所有实例被重启
+func (h *Health) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, h.Status())
+	})
+}
+
+func (c *Client) Health() HealthStatus {
+	return c.health.Status()
+}
+
+// 与 Health.ReadinessHandler 相同; NewClient 返回时初始加载已完成, 需要在此之前提供探针时使用 WithHealth
+func (c *Client) HealthHandler() http.Handler {
+	return c.health.ReadinessHandler()
+}
+
+func (c *Client) LivenessHandler() http.Handler {
+	return c.health.LivenessHandler()
+}
+
+func writeHealth(w http.ResponseWriter, code int, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
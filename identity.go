@@ -0,0 +1,173 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// 实例在 zookeeper 中注册的身份 节点名为 <host>_<port>_<id>
+type Identity struct {
+	Host     string            `json:"host"`
+	Port     string            `json:"port"`
+	Id       string            `json:"id"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Id 是否由 WithInstanceId 指定, 未指定时每次启动生成新的 uuid
+	fixedId bool
+}
+
+// 解析实例的 host (ip 或主机名)
+type HostResolver func() (string, error)
+
+const (
+	ENV_POD_IP   = "POD_IP"
+	ENV_HOSTNAME = "HOSTNAME"
+)
+
+func (i *Identity) path() string {
+	return fmt.Sprintf("/%v_%v_%v", i.Host, i.Port, i.Id)
+}
+
+// 灰度分桶使用的 key, 重启后不变: WithInstanceId 指定的 id, 否则为 host:port
+func (i *Identity) bucketKey() string {
+	if i.fixedId {
+		return i.Id
+	}
+	return i.Host + ":" + i.Port
+}
+
+func resolveIdentity(host, port, id string, resolver HostResolver, metadata map[string]string) (*Identity, error) {
+	identity := &Identity{
+		Host:     host,
+		Port:     port,
+		Id:       id,
+		Metadata: metadata,
+		fixedId:  id != EMPTY_STRING,
+	}
+	if identity.Host == EMPTY_STRING {
+		if resolver == nil {
+			resolver = DefaultHostResolver
+		}
+		h, err := resolver()
+		if err != nil {
+			return nil, fmt.Errorf("resolve host [err:%v]", err)
+		}
+		identity.Host = h
+	}
+	if identity.Port == EMPTY_STRING {
+		identity.Port = PORT
+	}
+	if identity.Id == EMPTY_STRING {
+		uuid, err := getGuid()
+		if err != nil {
+			return nil, err
+		}
+		identity.Id = uuid
+	}
+	return identity, nil
+}
+
+// 默认解析: 第一个非回环 ipv4, 没有时取第一个非回环 ipv6,
+// 只有回环地址时 (如离线的笔记本、最小化容器) 取回环地址, 没有地址时返回空, 不影响启动
+func DefaultHostResolver() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return EMPTY_STRING, err
+	}
+	return defaultIp(addrs), nil
+}
+
+func defaultIp(addrs []net.Addr) string {
+	if ip, err := pickIp(addrs, false); err == nil {
+		return ip
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsLoopback() {
+			return ipnet.IP.String()
+		}
+	}
+	return EMPTY_STRING
+}
+
+// 依次读取环境变量, 如 POD_IP、HOSTNAME
+func EnvHostResolver(names ...string) HostResolver {
+	if len(names) == 0 {
+		names = []string{ENV_POD_IP, ENV_HOSTNAME}
+	}
+	return func() (string, error) {
+		for _, name := range names {
+			if v := strings.TrimSpace(os.Getenv(name)); v != EMPTY_STRING {
+				return v, nil
+			}
+		}
+		return EMPTY_STRING, fmt.Errorf("env not set [names:%v]", names)
+	}
+}
+
+// 取指定网卡上的地址, preferIpv6 为 true 时优先取 ipv6
+func InterfaceHostResolver(name string, preferIpv6 bool) HostResolver {
+	return func() (string, error) {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return EMPTY_STRING, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return EMPTY_STRING, err
+		}
+		return pickIp(addrs, preferIpv6)
+	}
+}
+
+// 依次尝试, 返回第一个成功的结果
+func ChainHostResolver(resolvers ...HostResolver) HostResolver {
+	return func() (string, error) {
+		errs := []error{}
+		for _, r := range resolvers {
+			host, err := r()
+			if err == nil && host != EMPTY_STRING {
+				return host, nil
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return EMPTY_STRING, fmt.Errorf("no host resolved [errs:%v]", errs)
+	}
+}
+
+func pickIp(addrs []net.Addr, preferIpv6 bool) (string, error) {
+	var ipv4, ipv6 string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			if ipv4 == EMPTY_STRING {
+				ipv4 = ipnet.IP.String()
+			}
+			continue
+		}
+		if ipv6 == EMPTY_STRING {
+			ipv6 = ipnet.IP.String()
+		}
+	}
+	if preferIpv6 && ipv6 != EMPTY_STRING {
+		return ipv6, nil
+	}
+	if ipv4 != EMPTY_STRING {
+		return ipv4, nil
+	}
+	if ipv6 != EMPTY_STRING {
+		return ipv6, nil
+	}
+	return EMPTY_STRING, fmt.Errorf("no non-loopback address found")
+}
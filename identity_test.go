@@ -0,0 +1,76 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestResolveIdentity(t *testing.T) {
+	os.Setenv("DISCONF_TEST_POD_IP", "10.1.2.3")
+	defer os.Unsetenv("DISCONF_TEST_POD_IP")
+	identity, err := resolveIdentity(EMPTY_STRING, "9090", "abc",
+		ChainHostResolver(EnvHostResolver("DISCONF_TEST_NOT_SET"), EnvHostResolver("DISCONF_TEST_POD_IP")),
+		map[string]string{"zone": "a"})
+	if err != nil {
+		t.Fatalf("resolve identity [err:%v]", err)
+	}
+	if identity.path() != "/10.1.2.3_9090_abc" {
+		t.Fatalf("unexpected path [path:%v]", identity.path())
+	}
+	identity, err = resolveIdentity("fe80::1", EMPTY_STRING, EMPTY_STRING, nil, nil)
+	if err != nil {
+		t.Fatalf("resolve identity [err:%v]", err)
+	}
+	if identity.Port != PORT || identity.Id == EMPTY_STRING {
+		t.Fatalf("unexpected identity [identity:%+v]", identity)
+	}
+}
+
+func TestDefaultIp(t *testing.T) {
+	addr := func(ip string) net.Addr {
+		return &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(8, 32)}
+	}
+	if ip := defaultIp([]net.Addr{addr("127.0.0.1"), addr("10.0.0.2")}); ip != "10.0.0.2" {
+		t.Fatalf("unexpected ip [ip:%v]", ip)
+	}
+	// 只有回环地址时不返回错误
+	if ip := defaultIp([]net.Addr{addr("127.0.0.1")}); ip != "127.0.0.1" {
+		t.Fatalf("unexpected ip [ip:%v]", ip)
+	}
+	if ip := defaultIp(nil); ip != EMPTY_STRING {
+		t.Fatalf("unexpected ip [ip:%v]", ip)
+	}
+}
+
+// 没有 WithInstanceId 时每次启动的 id 不同, 分桶仍然不变
+func TestBucketKey(t *testing.T) {
+	first, _ := resolveIdentity("10.0.0.1", "9090", EMPTY_STRING, nil, nil)
+	second, _ := resolveIdentity("10.0.0.1", "9090", EMPTY_STRING, nil, nil)
+	if first.Id == second.Id || first.bucketKey() != "10.0.0.1:9090" || second.bucketKey() != first.bucketKey() {
+		t.Fatalf("unstable bucket key [first:%+v] [second:%+v]", first, second)
+	}
+	fixed, _ := resolveIdentity("10.0.0.1", "9090", "web-1", nil, nil)
+	if fixed.bucketKey() != "web-1" {
+		t.Fatalf("unexpected bucket key [key:%v]", fixed.bucketKey())
+	}
+	flag := &FeatureFlag{Enabled: true, Percentage: 50}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("feature.%v", i)
+		if flag.Evaluate(name, FlagContext{}, first) != flag.Evaluate(name, FlagContext{}, second) {
+			t.Fatalf("flag re-bucketed after restart [name:%v]", name)
+		}
+		percentage := 50.0
+		rule := &CanaryRule{Name: name, Percentage: &percentage}
+		if rule.Match(first) != rule.Match(second) {
+			t.Fatalf("canary re-bucketed after restart [name:%v]", name)
+		}
+	}
+}
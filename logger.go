@@ -0,0 +1,90 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// 结构化日志字段
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// 客户端日志接口, 通过 WithLogger 设置, 默认使用 logrus 的全局实例, log/slog 的适配在 disconfslog 包中
+// 日志级别由具体实现控制
+type Logger interface {
+	Debug(msg string, fields ...Field)
+
+	Info(msg string, fields ...Field)
+
+	Warn(msg string, fields ...Field)
+
+	Error(msg string, fields ...Field)
+
+	// 返回附带固定字段的 Logger
+	With(fields ...Field) Logger
+}
+
+const (
+	LOG_FIELD_APP        = "app"
+	LOG_FIELD_ENV        = "env"
+	LOG_FIELD_VERSION    = "version"
+	LOG_FIELD_KEY        = "key"
+	LOG_FIELD_TYPE       = "type"
+	LOG_FIELD_HOST       = "host"
+	LOG_FIELD_ATTEMPT    = "attempt"
+	LOG_FIELD_PATH       = "path"
+	LOG_FIELD_ERR        = "err"
+	LOG_FIELD_ZK_VERSION = "zkVersion"
+	LOG_FIELD_ENDPOINT   = "endpoint"
+)
+
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+// 适配 logrus, 如 NewLogrusLogger(logrus.StandardLogger())
+func NewLogrusLogger(logger logrus.FieldLogger) Logger {
+	return &logrusLogger{entry: logger.WithFields(logrus.Fields{})}
+}
+
+func (l *logrusLogger) withFields(fields []Field) *logrus.Entry {
+	if len(fields) == 0 {
+		return l.entry
+	}
+	f := make(logrus.Fields, len(fields))
+	for _, field := range fields {
+		f[field.Key] = field.Value
+	}
+	return l.entry.WithFields(f)
+}
+
+func (l *logrusLogger) Debug(msg string, fields ...Field) {
+	l.withFields(fields).Debug(msg)
+}
+
+func (l *logrusLogger) Info(msg string, fields ...Field) {
+	l.withFields(fields).Info(msg)
+}
+
+func (l *logrusLogger) Warn(msg string, fields ...Field) {
+	l.withFields(fields).Warn(msg)
+}
+
+func (l *logrusLogger) Error(msg string, fields ...Field) {
+	l.withFields(fields).Error(msg)
+}
+
+func (l *logrusLogger) With(fields ...Field) Logger {
+	return &logrusLogger{entry: l.withFields(fields)}
+}
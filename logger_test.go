@@ -0,0 +1,43 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogrusLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logrus.New()
+	l.Out = buf
+	l.Formatter = &logrus.JSONFormatter{}
+	l.Level = logrus.InfoLevel
+	logger := NewLogrusLogger(l).With(F(LOG_FIELD_APP, "demo"))
+	logger.Debug("hidden")
+	logger.Error("auto load", F(LOG_FIELD_KEY, "a"), F(LOG_FIELD_ERR, fmt.Errorf("timeout")))
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("unmarshal [err:%v] [out:%v]", err, buf.String())
+	}
+	if record["level"] != "error" || record["msg"] != "auto load" || record["app"] != "demo" || record["key"] != "a" ||
+		record["err"] != "timeout" {
+		t.Fatalf("unexpected record [record:%v]", record)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	c := newOptions([]ClientOption{WithLogger(nil)})
+	if c.logger == nil {
+		t.Fatalf("nil logger not replaced by default")
+	}
+	c.logger.With(F(LOG_FIELD_APP, "demo")).Debug("nil logger")
+}
@@ -0,0 +1,40 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"time"
+)
+
+// 客户端运行指标, 通过 WithMetrics 设置, 默认不采集
+type MetricsCollector interface {
+	// 每次对某个 host 的 http 请求, endpoint 为 DISCONF_*_ACTION
+	ObserveFetch(endpoint, host string, duration time.Duration, err error)
+
+	// 每次热加载 key
+	ObserveReload(key string, disconfType int, err error)
+
+	// 值转换为结构体字段类型失败
+	ObserveConversionError(key string)
+
+	SetZkConnected(connected bool)
+
+	// key 最近一次成功加载的时间
+	SetConfigUpdated(key string, t time.Time)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveFetch(endpoint, host string, duration time.Duration, err error) {}
+
+func (noopMetrics) ObserveReload(key string, disconfType int, err error) {}
+
+func (noopMetrics) ObserveConversionError(key string) {}
+
+func (noopMetrics) SetZkConnected(connected bool) {}
+
+func (noopMetrics) SetConfigUpdated(key string, t time.Time) {}
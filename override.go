@@ -0,0 +1,125 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 覆盖远程配置的一层来源, lookup 返回 key 的值和提供该值的名称 (环境变量名或 flag 名)
+type overrideLayer struct {
+	source string
+	lookup func(key string) (value string, name string, ok bool)
+}
+
+const (
+	SOURCE_ENV  = "env"
+	SOURCE_FLAG = "flag"
+)
+
+// 优先级从高到低: flag > 环境变量 > 远程配置项/配置文件 > 本地文件 > 默认值
+var overridePriority = map[string]int{
+	SOURCE_FLAG: 0,
+	SOURCE_ENV:  1,
+}
+
+// 用环境变量覆盖配置, key 映射为 prefix + 大写并把 . 和 - 替换为 _
+// 如 prefix 为 "APP_" 时 mysql.username 对应 APP_MYSQL_USERNAME
+func WithEnvOverrides(prefix string) ClientOption {
+	return WithEnvKeyMapping(func(key string) string {
+		return prefix + EnvKey(key)
+	})
+}
+
+// 自定义 key 到环境变量名的映射
+func WithEnvKeyMapping(mapping func(key string) string) ClientOption {
+	return withOverride(SOURCE_ENV, func(key string) (string, string, bool) {
+		name := mapping(key)
+		value, ok := os.LookupEnv(name)
+		return value, name, ok
+	})
+}
+
+// 用命令行参数覆盖配置, flag 名与 key 相同 (如 -mysql.username=root), 只有显式设置的 flag 生效
+// 需要在 flag.Parse 之后创建客户端
+func WithFlagOverrides(fs *flag.FlagSet) ClientOption {
+	return WithFlagLookup(func(key string) (string, bool) {
+		set := false
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == key {
+				set = true
+			}
+		})
+		if !set {
+			return EMPTY_STRING, false
+		}
+		return fs.Lookup(key).Value.String(), true
+	})
+}
+
+// 自定义 flag 查找, 便于接入 pflag 等:
+//
+//	WithFlagLookup(func(key string) (string, bool) {
+//		f := pflag.Lookup(key)
+//		if f == nil || !f.Changed {
+//			return "", false
+//		}
+//		return f.Value.String(), true
+//	})
+func WithFlagLookup(lookup func(key string) (string, bool)) ClientOption {
+	return withOverride(SOURCE_FLAG, func(key string) (string, string, bool) {
+		value, ok := lookup(key)
+		return value, key, ok
+	})
+}
+
+func withOverride(source string, lookup func(key string) (string, string, bool)) ClientOption {
+	return func(c *Client) {
+		layer := overrideLayer{source: source, lookup: lookup}
+		i := 0
+		for i < len(c.overrides) && overridePriority[c.overrides[i].source] <= overridePriority[source] {
+			i++
+		}
+		c.overrides = append(c.overrides, overrideLayer{})
+		copy(c.overrides[i+1:], c.overrides[i:])
+		c.overrides[i] = layer
+	}
+}
+
+// mysql.username -> MYSQL_USERNAME
+func EnvKey(key string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// 按优先级查找覆盖值
+func (s *Store) override(key string) (string, origin, bool) {
+	for _, layer := range s.overrides {
+		if value, name, ok := layer.lookup(key); ok {
+			return value, origin{source: layer.source, file: name}, true
+		}
+	}
+	return EMPTY_STRING, origin{}, false
+}
+
+// 初始加载后应用覆盖值, 包括远程和本地都没有提供的 key
+func (s *Store) applyOverrides() error {
+	if len(s.overrides) == 0 {
+		return nil
+	}
+	for _, key := range s.keys() {
+		if _, _, ok := s.override(key); !ok {
+			continue
+		}
+		if errs := s.resolveConf(key, INIT_CONF, false); len(errs) > 0 {
+			return fmt.Errorf("apply override [key:%v] [errs:%v]", key, errs)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	PLACEHOLDER_PREFIX    = "${"
+	PLACEHOLDER_SUFFIX    = "}"
+	PLACEHOLDER_SEPARATOR = ":"
+	// $${name} 表示文本 ${name}, 不解析
+	PLACEHOLDER_ESCAPE = "$"
+)
+
+// 占位符在配置项和配置文件中都找不到时查找同名环境变量, 默认不查找,
+// 避免已有配置值中的 ${HOME} 等文本被环境变量替换
+func WithEnvPlaceholders() ClientOption {
+	return func(c *Client) {
+		c.envPlaceholders = true
+	}
+}
+
+// 找不到且没有默认值的占位符以及未闭合的 ${ 返回错误, 默认原样保留, 兼容值中本来就有 ${...} 文本的配置
+func WithStrictPlaceholders() ClientOption {
+	return func(c *Client) {
+		c.strictPlaceholders = true
+	}
+}
+
+// 加载的原始值, 解析占位符后才设置到字段
+type rawValue struct {
+	value  string
+	origin origin
+}
+
+// 多个订阅中都有 key 时保留优先级高的值, 调用方需持有 mutex
+func (s *Store) setRaw(key, value string, o origin) {
+	if s.raws == nil {
+		s.raws = make(map[string]rawValue)
+	}
+	if r, ok := s.raws[key]; !ok || s.priority(o.subscription) <= s.priority(r.origin.subscription) {
+		s.raws[key] = rawValue{value: value, origin: o}
+	}
+	if o.file == EMPTY_STRING {
+		if s.itemRaws == nil {
+			s.itemRaws = make(map[string]map[string]rawValue)
+		}
+		if s.itemRaws[o.subscription] == nil {
+			s.itemRaws[o.subscription] = make(map[string]rawValue)
+		}
+		s.itemRaws[o.subscription][key] = rawValue{value: value, origin: o}
+		return
+	}
+	if s.fileRaws == nil {
+		s.fileRaws = make(map[string]map[string]rawValue)
+	}
+	if s.fileRaws[o.fileKey()] == nil {
+		s.fileRaws[o.fileKey()] = make(map[string]rawValue)
+	}
+	s.fileRaws[o.fileKey()][key] = rawValue{value: value, origin: o}
+}
+
+// 文件重新加载后删除文件中已不存在的 key, 该 key 的值由其他配置项或文件中的值接替,
+// 返回删除的 key, 调用方需持有 mutex
+func (s *Store) pruneRaws(o origin, fileMap map[string]string) []string {
+	removed := []string{}
+	raws := s.fileRaws[o.fileKey()]
+	for key := range raws {
+		if _, ok := fileMap[key]; ok {
+			continue
+		}
+		delete(raws, key)
+		removed = append(removed, key)
+		if r, ok := s.raws[key]; ok && r.origin.fileKey() == o.fileKey() {
+			delete(s.raws, key)
+			if r, ok := s.fallbackRaw(key); ok {
+				s.raws[key] = r
+			}
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// 其他配置项和文件中 key 的值, 取优先级最高的
+func (s *Store) fallbackRaw(key string) (rawValue, bool) {
+	candidates := []rawValue{}
+	for _, raws := range s.itemRaws {
+		if r, ok := raws[key]; ok {
+			candidates = append(candidates, r)
+		}
+	}
+	for _, raws := range s.fileRaws {
+		if r, ok := raws[key]; ok {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		return rawValue{}, false
+	}
+	best := candidates[0]
+	for _, r := range candidates[1:] {
+		if s.priority(r.origin.subscription) < s.priority(best.origin.subscription) {
+			best = r
+		}
+	}
+	return best, true
+}
+
+// 订阅的优先级, 越小越优先
+func (s *Store) priority(subscription string) int {
+	for i, name := range s.subscriptions {
+		if name == subscription {
+			return i
+		}
+	}
+	return 0
+}
+
+// key 的原始值, 依次为覆盖值、灰度值和加载的值, 调用方需持有 mutex
+func (s *Store) rawValue(key string) (string, origin, bool) {
+	if value, o, ok := s.override(key); ok {
+		return value, o, true
+	}
+	if r, ok := s.canary.values[key]; ok {
+		return r.value, r.origin, true
+	}
+	r, ok := s.raws[key]
+	return r.value, r.origin, ok
+}
+
+// key 所有可能生效的原始值, 包括 WithBindFile 绑定的文件中的值
+func (s *Store) rawValues(key string) []string {
+	values := []string{}
+	if value, _, ok := s.rawValue(key); ok {
+		values = append(values, value)
+	}
+	for _, raws := range s.fileRaws {
+		if r, ok := raws[key]; ok {
+			values = append(values, r.value)
+		}
+	}
+	return values
+}
+
+// 解析 ${name} 和 ${name:default}, name 依次查找已加载的配置项和配置文件中的 key、环境变量 (WithEnvPlaceholders),
+// 都没有时使用默认值, 默认值中也可以有占位符, 仍找不到时原样保留 (WithStrictPlaceholders 时返回错误).
+// $${ 还原为 ${. stack 为正在解析的 key, 用于检测循环引用
+func (s *Store) resolve(value string, stack []string) (string, error) {
+	if !strings.Contains(value, PLACEHOLDER_PREFIX) {
+		return value, nil
+	}
+	buf := &bytes.Buffer{}
+	for {
+		start, escaped := nextPlaceholder(value)
+		if start < 0 {
+			buf.WriteString(value)
+			return buf.String(), nil
+		}
+		if escaped {
+			buf.WriteString(value[:start-len(PLACEHOLDER_ESCAPE)] + PLACEHOLDER_PREFIX)
+			value = value[start+len(PLACEHOLDER_PREFIX):]
+			continue
+		}
+		end := placeholderEnd(value, start)
+		if end < 0 {
+			if s.strictPlaceholders {
+				return EMPTY_STRING, fmt.Errorf("unclosed placeholder [value:%v]", value)
+			}
+			buf.WriteString(value)
+			return buf.String(), nil
+		}
+		buf.WriteString(value[:start])
+		name, def, hasDef := splitPlaceholder(value[start+len(PLACEHOLDER_PREFIX) : end])
+		v, ok, err := s.lookupPlaceholder(name, def, hasDef, stack)
+		if err != nil {
+			return EMPTY_STRING, err
+		}
+		if !ok {
+			v = value[start : end+len(PLACEHOLDER_SUFFIX)]
+		}
+		buf.WriteString(v)
+		value = value[end+len(PLACEHOLDER_SUFFIX):]
+	}
+}
+
+// 找不到且没有默认值时返回 false, WithStrictPlaceholders 时返回错误
+func (s *Store) lookupPlaceholder(name, def string, hasDef bool, stack []string) (string, bool, error) {
+	for i, key := range stack {
+		if key == name {
+			return EMPTY_STRING, false, fmt.Errorf("placeholder cycle [keys:%v]",
+				strings.Join(append(stack[i:], name), " -> "))
+		}
+	}
+	if value, _, ok := s.rawValue(name); ok {
+		v, err := s.resolve(value, append(stack, name))
+		return v, err == nil, err
+	}
+	if s.envPlaceholders {
+		if value, ok := os.LookupEnv(name); ok {
+			return value, true, nil
+		}
+	}
+	if hasDef {
+		v, err := s.resolve(def, stack)
+		return v, err == nil, err
+	}
+	if s.strictPlaceholders {
+		return EMPTY_STRING, false, fmt.Errorf("unresolved placeholder [name:%v]", name)
+	}
+	return EMPTY_STRING, false, nil
+}
+
+// 下一个 ${ 的位置, escaped 表示前面有 $, 即 $${
+func nextPlaceholder(value string) (int, bool) {
+	start := strings.Index(value, PLACEHOLDER_PREFIX)
+	if start < 0 {
+		return -1, false
+	}
+	return start, strings.HasSuffix(value[:start], PLACEHOLDER_ESCAPE)
+}
+
+// start 处 ${ 对应的 } 的位置, 支持嵌套
+func placeholderEnd(value string, start int) int {
+	depth := 0
+	for i := start; i < len(value); i++ {
+		switch {
+		case strings.HasPrefix(value[i:], PLACEHOLDER_PREFIX):
+			depth++
+			i += len(PLACEHOLDER_PREFIX) - 1
+		case strings.HasPrefix(value[i:], PLACEHOLDER_SUFFIX):
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// 按第一个不在嵌套占位符中的 : 拆分名称和默认值
+func splitPlaceholder(content string) (string, string, bool) {
+	depth := 0
+	for i := 0; i < len(content); i++ {
+		switch {
+		case strings.HasPrefix(content[i:], PLACEHOLDER_PREFIX):
+			depth++
+			i += len(PLACEHOLDER_PREFIX) - 1
+		case strings.HasPrefix(content[i:], PLACEHOLDER_SUFFIX):
+			depth--
+		case depth == 0 && strings.HasPrefix(content[i:], PLACEHOLDER_SEPARATOR):
+			return content[:i], content[i+len(PLACEHOLDER_SEPARATOR):], true
+		}
+	}
+	return content, EMPTY_STRING, false
+}
+
+// value 中引用的所有名称, 包括默认值中的
+func placeholderNames(value string) []string {
+	names := []string{}
+	for {
+		start, escaped := nextPlaceholder(value)
+		if start < 0 {
+			return names
+		}
+		if escaped {
+			value = value[start+len(PLACEHOLDER_PREFIX):]
+			continue
+		}
+		end := placeholderEnd(value, start)
+		if end < 0 {
+			return names
+		}
+		name, def, _ := splitPlaceholder(value[start+len(PLACEHOLDER_PREFIX) : end])
+		names = append(names, name)
+		names = append(names, placeholderNames(def)...)
+		value = value[end+len(PLACEHOLDER_SUFFIX):]
+	}
+}
+
+// 直接或间接引用 key 的其他 key, key 热加载后需要重新解析
+func (s *Store) dependents(key string) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	refs := make(map[string][]string)
+	candidates := s.keys()
+	for k := range s.raws {
+		candidates = append(candidates, k)
+	}
+	for _, k := range candidates {
+		if value, _, ok := s.rawValue(k); ok {
+			for _, name := range placeholderNames(value) {
+				refs[name] = append(refs[name], k)
+			}
+		}
+	}
+	// WithBindFile 绑定的 key 使用所在文件中的值
+	for _, raws := range s.fileRaws {
+		for k, r := range raws {
+			for _, name := range placeholderNames(r.value) {
+				refs[name] = append(refs[name], k)
+			}
+		}
+	}
+	seen := map[string]bool{key: true}
+	queue := []string{key}
+	deps := []string{}
+	for len(queue) > 0 {
+		for _, k := range refs[queue[0]] {
+			if !seen[k] {
+				seen[k] = true
+				deps = append(deps, k)
+				queue = append(queue, k)
+			}
+		}
+		queue = queue[1:]
+	}
+	return deps
+}
+
+// 初始加载后统一解析含占位符的 key, 此时所有配置项和配置文件都已加载, 与加载顺序无关
+func (s *Store) resolvePlaceholders() error {
+	s.mutex.RLock()
+	keys := []string{}
+	seen := make(map[string]bool)
+	for key, r := range s.raws {
+		if strings.Contains(r.value, PLACEHOLDER_PREFIX) && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, raws := range s.fileRaws {
+		for key, r := range raws {
+			if strings.Contains(r.value, PLACEHOLDER_PREFIX) && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	for key, r := range s.canary.values {
+		if strings.Contains(r.value, PLACEHOLDER_PREFIX) && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	s.mutex.RUnlock()
+	sort.Strings(keys)
+	var errs []error
+	for _, key := range keys {
+		errs = append(errs, s.resolveConf(key, INIT_CONF, false)...)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("resolve placeholders [errs:%v]", errs)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus 文本格式的 MetricsCollector 实现, 本身是一个 http.Handler,
+// 挂到 /metrics 即可被抓取, 不依赖 prometheus client 库
+// 它不是 prometheus.Collector, 不能注册到应用已有的 registry, 需要单独的抓取路径 (如 /metrics/disconf);
+// 需要统一 registry 时, 用 prometheus client 库自行实现 MetricsCollector
+//
+//	metrics := NewPrometheusMetrics("disconf")
+//	http.Handle("/metrics", metrics)
+//	NewConf(..., WithMetrics(metrics))
+type PrometheusMetrics struct {
+	namespace string
+	buckets   []float64
+	mutex     sync.Mutex
+
+	fetchDuration     map[string]*histogram
+	fetchErrors       map[string]float64
+	reloads           map[string]float64
+	reloadFailures    map[string]float64
+	conversionErrors  map[string]float64
+	zkConnected       float64
+	configUpdatedUnix map[string]float64
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+const (
+	PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var DEFAULT_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		namespace:         namespace,
+		buckets:           DEFAULT_BUCKETS,
+		fetchDuration:     make(map[string]*histogram),
+		fetchErrors:       make(map[string]float64),
+		reloads:           make(map[string]float64),
+		reloadFailures:    make(map[string]float64),
+		conversionErrors:  make(map[string]float64),
+		configUpdatedUnix: make(map[string]float64),
+	}
+}
+
+func (p *PrometheusMetrics) ObserveFetch(endpoint, host string, duration time.Duration, err error) {
+	labels := formatLabels("endpoint", endpoint, "host", host)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	h, ok := p.fetchDuration[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(p.buckets))}
+		p.fetchDuration[labels] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range p.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+	if err != nil {
+		p.fetchErrors[labels]++
+	}
+}
+
+func (p *PrometheusMetrics) ObserveReload(key string, disconfType int, err error) {
+	labels := formatLabels("key", key, "type", disconfTypeName(disconfType))
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.reloads[labels]++
+	if err != nil {
+		p.reloadFailures[labels]++
+	}
+}
+
+func (p *PrometheusMetrics) ObserveConversionError(key string) {
+	labels := formatLabels("key", key)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.conversionErrors[labels]++
+}
+
+func (p *PrometheusMetrics) SetZkConnected(connected bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.zkConnected = 0
+	if connected {
+		p.zkConnected = 1
+	}
+}
+
+func (p *PrometheusMetrics) SetConfigUpdated(key string, t time.Time) {
+	labels := formatLabels("key", key)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.configUpdatedUnix[labels] = float64(t.UnixNano()) / float64(time.Second)
+}
+
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", PROMETHEUS_CONTENT_TYPE)
+	w.Write(p.Gather())
+}
+
+// 以 Prometheus 文本格式输出当前所有指标
+func (p *PrometheusMetrics) Gather() []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	buf := &bytes.Buffer{}
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+
+	name := p.name("fetch_duration_seconds")
+	writeHeader(buf, name, "histogram", "Latency of http requests to the disconf server.")
+	for _, labels := range sortedLabels(p.fetchDuration) {
+		h := p.fetchDuration[labels]
+		for i, bound := range p.buckets {
+			fmt.Fprintf(buf, "%v_bucket{%v,le=\"%v\"} %v\n", name, labels, bound, h.counts[i])
+		}
+		fmt.Fprintf(buf, "%v_bucket{%v,le=\"+Inf\"} %v\n", name, labels, h.count)
+		fmt.Fprintf(buf, "%v_sum{%v} %v\n", name, labels, h.sum)
+		fmt.Fprintf(buf, "%v_count{%v} %v\n", name, labels, h.count)
+	}
+	p.writeValues(buf, "fetch_errors_total", "counter", "Failed http requests to the disconf server.", p.fetchErrors)
+	p.writeValues(buf, "reloads_total", "counter", "Hot reloads triggered by zookeeper.", p.reloads)
+	p.writeValues(buf, "reload_failures_total", "counter", "Hot reloads that failed.", p.reloadFailures)
+	p.writeValues(buf, "conversion_errors_total", "counter", "Values that could not be converted to the field type.", p.conversionErrors)
+
+	name = p.name("zk_connected")
+	writeHeader(buf, name, "gauge", "Whether the zookeeper session is connected.")
+	fmt.Fprintf(buf, "%v %v\n", name, p.zkConnected)
+
+	p.writeValues(buf, "config_last_update_timestamp_seconds", "gauge", "Unix time of the last successful load of a key.", p.configUpdatedUnix)
+	ages := make(map[string]float64, len(p.configUpdatedUnix))
+	for labels, updated := range p.configUpdatedUnix {
+		ages[labels] = now - updated
+	}
+	p.writeValues(buf, "config_age_seconds", "gauge", "Seconds since the last successful load of a key.", ages)
+	return buf.Bytes()
+}
+
+func (p *PrometheusMetrics) name(metric string) string {
+	if p.namespace == EMPTY_STRING {
+		return metric
+	}
+	return metricName(p.namespace) + "_" + metric
+}
+
+// 指标名只能包含 [a-zA-Z0-9_:] 且不能以数字开头, 其他字符替换为 _
+func metricName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func (p *PrometheusMetrics) writeValues(buf *bytes.Buffer, metric, metricType, help string, values map[string]float64) {
+	name := p.name(metric)
+	writeHeader(buf, name, metricType, help)
+	keys := make([]string, 0, len(values))
+	for labels := range values {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		fmt.Fprintf(buf, "%v{%v} %v\n", name, labels, values[labels])
+	}
+}
+
+func writeHeader(buf *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(buf, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %v %v\n", name, metricType)
+}
+
+func sortedLabels(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 文本格式中标签值需要转义反斜杠、双引号和换行
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%v=\"%v\"", pairs[i], labelReplacer.Replace(pairs[i+1])))
+	}
+	return strings.Join(labels, ",")
+}
+
+func disconfTypeName(disconfType int) string {
+	switch disconfType {
+	case DISCONF_TYPE_FILE:
+		return "file"
+	case DISCONF_TYPE_ITEM:
+		return "item"
+	}
+	return "unknown"
+}
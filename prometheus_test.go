@@ -0,0 +1,78 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client_test
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	disconf "github.com/scriptllh/go-disconf-client"
+)
+
+var (
+	// 文本格式的样本行: 指标名、可选的标签和值, 标签值中只允许 \\、\" 和 \n 三种转义
+	sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(?:[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\[\\"n])*",?)*\})? (\S+)$`)
+	typeLine   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge|histogram)$`)
+	helpLine   = regexp.MustCompile(`^# HELP ([a-zA-Z_:][a-zA-Z0-9_:]*) [^\n]*$`)
+)
+
+// 按 Prometheus 文本格式 0.0.4 检查输出, 样本必须属于之前声明的指标
+func checkExposition(t *testing.T, out string) {
+	family, familyType := "", ""
+	for i, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if m := typeLine.FindStringSubmatch(line); m != nil {
+			family, familyType = m[1], m[2]
+			continue
+		}
+		if helpLine.MatchString(line) {
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("invalid line [line:%v] [text:%q]", i+1, line)
+		}
+		name := m[1]
+		if familyType == "histogram" {
+			name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")
+		}
+		if name != family {
+			t.Fatalf("sample outside its family [line:%v] [family:%v] [text:%q]", i+1, family, line)
+		}
+		if _, err := strconv.ParseFloat(m[3], 64); err != nil {
+			t.Fatalf("invalid value [line:%v] [text:%q] [err:%v]", i+1, line, err)
+		}
+	}
+}
+
+func TestPrometheusExposition(t *testing.T) {
+	metrics := disconf.NewPrometheusMetrics("my-app.disconf")
+	key := "a\"b\\c\nd"
+	metrics.ObserveFetch(disconf.DISCONF_ITEM_ACTION, "h1:8080", 30*time.Millisecond, nil)
+	metrics.ObserveFetch(disconf.DISCONF_ITEM_ACTION, "h1:8080", 2*time.Second, fmt.Errorf("timeout"))
+	metrics.ObserveReload(key, disconf.DISCONF_TYPE_ITEM, fmt.Errorf("convert"))
+	metrics.ObserveConversionError(key)
+	metrics.SetZkConnected(true)
+	metrics.SetConfigUpdated(key, time.Unix(1500000000, 0))
+	out := string(metrics.Gather())
+	checkExposition(t, out)
+	for _, want := range []string{
+		`my_app_disconf_reloads_total{key="a\"b\\c\nd",type="item"} 1`,
+		`my_app_disconf_fetch_duration_seconds_bucket{endpoint="/api/config/item",host="h1:8080",le="0.05"} 1`,
+		`my_app_disconf_fetch_duration_seconds_bucket{endpoint="/api/config/item",host="h1:8080",le="+Inf"} 2`,
+		`my_app_disconf_fetch_errors_total{endpoint="/api/config/item",host="h1:8080"} 1`,
+		`my_app_disconf_config_last_update_timestamp_seconds{key="a\"b\\c\nd"} 1.5e+09`,
+		"my_app_disconf_zk_connected 1",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Fatalf("sample not found [want:%v] [out:%v]", want, out)
+		}
+	}
+}
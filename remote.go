@@ -0,0 +1,84 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// 服务端上一组 app/version/env 的全部配置, 用于命令行工具
+type RemoteConfig struct {
+	App     string
+	Version string
+	Env     string
+	// 服务端返回的配置列表, 顺序与客户端加载的顺序相同
+	Confs []*Result
+	Items map[string]string
+	// properties 配置文件解析后的 key/value, 其他配置文件只在 Confs 中
+	Files map[string]map[string]string
+}
+
+// 获取配置列表并读取所有 properties 配置文件, 不写入下载目录
+func (f Fetcher) FetchAll(ctx context.Context, app, version, env string) (*RemoteConfig, error) {
+	prefix := fmt.Sprintf(SUFFIX_PREFIX_URL, app, env, version)
+	confs, errs := f.GetAllConf(ctx, prefix)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("get all conf [errs:%v]", errs)
+	}
+	remote := &RemoteConfig{
+		App:     app,
+		Version: version,
+		Env:     env,
+		Confs:   confs,
+		Items:   make(map[string]string),
+		Files:   make(map[string]map[string]string),
+	}
+	for _, conf := range confs {
+		switch conf.Genre {
+		case DISCONF_TYPE_ITEM:
+			remote.Items[conf.Name] = conf.Value
+		case DISCONF_TYPE_FILE:
+			if !strings.HasSuffix(conf.Name, FILE_PROPERTIES) {
+				continue
+			}
+			data, errs := f.GetFile(ctx, prefix+fmt.Sprintf(SUFFIX_KEY, conf.Name))
+			if len(errs) > 0 {
+				return nil, fmt.Errorf("get file [fileName:%v] [errs:%v]", conf.Name, errs)
+			}
+			p, err := readProperties(conf.Name, data, charsetOf(f.charset, f.fileCharsets, conf.Name))
+			if err != nil {
+				return nil, fmt.Errorf("read properties [fileName:%v] [err:%v]", conf.Name, err)
+			}
+			fileMap := make(map[string]string)
+			for _, key := range p.Keys() {
+				if fileMap[key], err = p.Get(key); err != nil {
+					return nil, fmt.Errorf("read properties [fileName:%v] [key:%v] [err:%v]", conf.Name, key, err)
+				}
+			}
+			remote.Files[conf.Name] = fileMap
+		}
+	}
+	return remote, nil
+}
+
+// 配置项和 properties 文件合并后的 key/value, 与客户端相同, 后加载的值覆盖先加载的
+func (r *RemoteConfig) Merged() map[string]string {
+	merged := make(map[string]string)
+	for _, conf := range r.Confs {
+		switch conf.Genre {
+		case DISCONF_TYPE_ITEM:
+			merged[conf.Name] = conf.Value
+		case DISCONF_TYPE_FILE:
+			for key, value := range r.Files[conf.Name] {
+				merged[key] = value
+			}
+		}
+	}
+	return merged
+}
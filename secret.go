@@ -0,0 +1,153 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// 按 key 的通配符规则标记敏感配置, 如 "*.password"、"*secret*", 不区分大小写
+// 与 secret:"true" 标签效果相同: 日志、调试输出、zk 节点和本地文件中的值会被掩码
+func WithSecretKeys(patterns ...string) ClientOption {
+	return func(c *Client) {
+		c.secretKeys = append(c.secretKeys, patterns...)
+	}
+}
+
+// 按 WithSecretKeys 的通配符规则判断 key 是否敏感, 用于命令行工具等不绑定结构体的场景
+func MatchSecretKey(key string, patterns ...string) bool {
+	lower := strings.ToLower(key)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), lower); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 敏感 key 的值和 ENC(...) 加密值替换为 SECRET_MASK, 其他原样返回
+func MaskValue(key, value string, patterns ...string) string {
+	if MatchSecretKey(key, patterns...) || isEncrypted(value) {
+		return SECRET_MASK
+	}
+	return value
+}
+
+// 值中的占位符引用了敏感 key 时, 解析后的值含有明文, 也按敏感处理
+// 热加载 goroutine 中调用时 Bind 可能同时在修改 targets, 需加读锁
+func (s *Store) isSecret(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.isSecretLocked(key)
+}
+
+// 调用方需持有 mutex
+func (s *Store) isSecretLocked(key string) bool {
+	return s.secret(key, make(map[string]bool))
+}
+
+func (s *Store) secret(key string, seen map[string]bool) bool {
+	if seen[key] {
+		return false
+	}
+	seen[key] = true
+	if MatchSecretKey(key, s.secretKeys...) {
+		return true
+	}
+	for _, t := range s.targets {
+		elems := reflect.TypeOf(t.conf).Elem()
+		for _, i := range t.fields(key) {
+			if elems.Field(i).Tag.Get(SECRET_TAG) == SECRET_TRUE {
+				return true
+			}
+		}
+	}
+	for _, value := range s.rawValues(key) {
+		for _, name := range placeholderNames(value) {
+			if s.secret(name, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Store) maskValue(key, value string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.maskValueLocked(key, value)
+}
+
+// 灰度规则中敏感 key 的值也会被掩码, 调用方需持有 mutex
+func (s *Store) maskValueLocked(key, value string) string {
+	if s.isSecretLocked(key) {
+		return SECRET_MASK
+	}
+	if s.canaryKey != EMPTY_STRING && key == s.canaryKey {
+		return s.maskCanaryRules(value)
+	}
+	return value
+}
+
+// 返回掩码后的副本, 用于写入 zk 节点
+func (s *Store) maskMap(m map[string]string) map[string]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	masked := make(map[string]string, len(m))
+	for k, v := range m {
+		masked[k] = s.maskValueLocked(k, v)
+	}
+	return masked
+}
+
+// 去掉错误信息中的敏感值, 如 strconv.ParseInt: parsing "xxx": invalid syntax, 调用方需持有 mutex
+func (s *Store) maskErrors(key, value string, errs []error) []error {
+	if value == EMPTY_STRING || !s.isSecretLocked(key) {
+		return errs
+	}
+	masked := make([]error, 0, len(errs))
+	for _, err := range errs {
+		masked = append(masked, errors.New(strings.Replace(err.Error(), value, SECRET_MASK, -1)))
+	}
+	return masked
+}
+
+// 把 properties 文件内容中的敏感值替换为掩码, 下载的文件写入本地前调用, 本地文件不保留明文
+// 按文件编码解码后使用与解析相同的规则拆分 key, 其他行原样保留, 结果按原编码写回
+func (s *Store) maskProperties(fileName string, content []byte) ([]byte, error) {
+	charset := s.fileCharset(fileName)
+	data, unescape, err := decodeProperties(content, charset)
+	if err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(data, []byte{'\n'})
+	changed := false
+	for i, line := range lines {
+		key, _, ok := splitProperty(line)
+		if !ok {
+			continue
+		}
+		if unescape {
+			key = unescapeUnicode(key)
+		}
+		if !s.isSecret(key) {
+			continue
+		}
+		// 保留原始的 key 文本, 包括其中的转义
+		trimmed := bytes.TrimSpace(line)
+		lines[i] = []byte(string(bytes.TrimSpace(trimmed[:propertySeparator(trimmed)])) + "=" + SECRET_MASK)
+		changed = true
+	}
+	if !changed {
+		return content, nil
+	}
+	return encodeProperties(bytes.Join(lines, []byte{'\n'}), content, charset)
+}
@@ -0,0 +1,96 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// 每个配置项/配置文件最近一次应用的结果
+type KeyStatus struct {
+	Key         string   `json:"key"`
+	DisconfType int      `json:"type"`
+	Hash        string   `json:"hash"`
+	Version     int32    `json:"version"`
+	AppliedAt   int64    `json:"appliedAt"`
+	Success     bool     `json:"success"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+// 写入 /disconf/<app>_<version>_<env>/instance/<host>_<port>_<id> 的内容
+// 每个 key 下的临时节点仍然写配置值本身, 以兼容 disconf 控制台的一致性检查,
+// Hash 为该临时节点内容的 md5, 可直接和控制台的值比对
+type InstanceStatus struct {
+	*Identity
+	UpdatedAt int64                 `json:"updatedAt"`
+	Keys      map[string]*KeyStatus `json:"keys"`
+	// 当前实例生效的灰度 key 和规则名
+	Canary map[string]string `json:"canary,omitempty"`
+}
+
+type statusReporter struct {
+	mutex  sync.Mutex
+	status *InstanceStatus
+}
+
+func newStatusReporter(identity *Identity) *statusReporter {
+	return &statusReporter{
+		status: &InstanceStatus{
+			Identity: identity,
+			Keys:     make(map[string]*KeyStatus),
+		},
+	}
+}
+
+func (r *statusReporter) record(key string, disconfType int, value []byte, version int32, errs ...error) *KeyStatus {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	keyStatus := &KeyStatus{
+		Key:         key,
+		DisconfType: disconfType,
+		Hash:        getMd5String(string(value)),
+		Version:     version,
+		AppliedAt:   now,
+		Success:     true,
+	}
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		keyStatus.Success = false
+		keyStatus.Errors = append(keyStatus.Errors, err.Error())
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.status.Keys[key] = keyStatus
+	r.status.UpdatedAt = now
+	return keyStatus
+}
+
+func (r *statusReporter) setCanary(canary map[string]string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.status.Canary = canary
+}
+
+func (r *statusReporter) marshal() ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return json.Marshal(r.status)
+}
+
+// 当前实例各 key 的应用状态
+func (r *statusReporter) snapshot() map[string]KeyStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	keys := make(map[string]KeyStatus, len(r.status.Keys))
+	for k, v := range r.status.Keys {
+		keys[k] = *v
+	}
+	return keys
+}
@@ -8,15 +8,68 @@ package disconf_client
 
 import (
 	"github.com/tietang/props/kvs"
+	"bytes"
 	"strings"
 	"io/ioutil"
 	"reflect"
 	"fmt"
 	"strconv"
+	"sync"
+	"time"
+	"errors"
+	"os"
 )
 
 type Store struct {
-	conf interface{}
+	targets []*target
+	metrics MetricsCollector
+	// 保护 targets、conf 的写入和 origins
+	mutex   sync.RWMutex
+	origins map[string]*keyOrigin
+	// 最近一次解析的 properties 文件
+	files      map[string]map[string]string
+	// 加载的原始值, 可能含有占位符
+	raws       map[string]rawValue
+	fileRaws   map[string]map[string]rawValue
+	// 各订阅的配置项的原始值, 文件中的 key 删除后用于恢复
+	itemRaws   map[string]map[string]rawValue
+	secretKeys []string
+	decrypters map[string]Decrypter
+	overrides  []overrideLayer
+	// properties 文件编码
+	charset      string
+	fileCharsets map[string]string
+	// 占位符是否查找环境变量
+	envPlaceholders bool
+	// 找不到的占位符是否报错, 默认原样保留
+	strictPlaceholders bool
+	// 订阅名, 按优先级从高到低
+	subscriptions []string
+	// 待调用的 Value[T] 变化通知
+	pending []func()
+	// 灰度规则所在的配置项, 为空时不启用灰度
+	canaryKey string
+	identity  *Identity
+	canary    canaryState
+}
+
+// 配置值的来源, subscription 为 WithSubscription 订阅的 <app>_<version>_<env>, 客户端自身的为空
+type origin struct {
+	source       string
+	file         string
+	subscription string
+}
+
+// 缓存和 WithBindFile 使用的文件名, 其他订阅的文件加上订阅名前缀
+func (o origin) fileKey() string {
+	return qualifyName(o.subscription, o.file)
+}
+
+type keyOrigin struct {
+	origin
+	updatedAt time.Time
+	version   int32
+	encrypted bool
 }
 
 const (
@@ -38,9 +91,13 @@ const (
 	ERR_TYPE_VALUE    = "unknown type"
 )
 
-func (s *Store) loadPropertiesDir(filePath string, ignore string) error {
+func (s *Store) loadPropertiesDir(filePath string, ignore string, subscription string) error {
 	files, err := ioutil.ReadDir(filePath)
 	if err != nil {
+		// 其他订阅的目录不存在时没有本地配置
+		if subscription != EMPTY_STRING && os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
 	for _, file := range files {
@@ -50,31 +107,115 @@ func (s *Store) loadPropertiesDir(filePath string, ignore string) error {
 		if ContainString(ignore, file.Name()) {
 			continue
 		}
-		if _, err = s.loadProperties(filePath, file.Name(), INIT_CONF); err != nil {
+		if _, err = s.loadProperties(filePath, file.Name(), INIT_CONF, origin{SOURCE_LOCAL_FILE, file.Name(), subscription}); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (s *Store) loadProperties(filePath, fileName, flag string, ) (map[string]string, error) {
-	ok := strings.HasSuffix(fileName, FILE_PROPERTIES)
+func (s *Store) loadProperties(filePath, fileName, flag string, o origin) (map[string]string, error) {
+	if !strings.HasSuffix(fileName, FILE_PROPERTIES) {
+		return make(map[string]string), nil
+	}
+	data, err := ioutil.ReadFile(filePath + fileName)
+	if err != nil {
+		return nil, err
+	}
+	return s.loadPropertiesData(fileName, data, flag, o)
+}
+
+// 从内存中的文件内容加载, 远程文件使用下载到的明文, 本地只保存掩码后的副本
+func (s *Store) loadPropertiesData(fileName string, data []byte, flag string, o origin) (map[string]string, error) {
+	if !strings.HasSuffix(fileName, FILE_PROPERTIES) {
+		return make(map[string]string), nil
+	}
+	p, err := readProperties(fileName, data, s.fileCharset(fileName))
+	if err != nil {
+		return nil, err
+	}
 	var errs []error
 	fileMap := make(map[string]string)
-	if ok {
-		p, err := kvs.ReadPropertyFile(filePath + fileName)
-		if err != nil {
-			return nil, err
-		}
-		fileMap, errs = s.convertProperties(p, flag)
-		if len(errs) > 0 {
-			return fileMap, fmt.Errorf("convert properties [errs:%v]", errs)
+	if s.isCanaryFile(fileName) {
+		for _, key := range p.Keys() {
+			fileMap[key], _ = p.Get(key)
 		}
+		s.mutex.Lock()
+		changed := s.setCanaryFile(fileName, fileMap)
+		s.mutex.Unlock()
+		errs = s.refresh(changed, flag)
+	} else {
+		fileMap, errs = s.convertProperties(p, flag, o)
+		s.mutex.Lock()
+		removed := s.pruneRaws(o, fileMap)
+		s.mutex.Unlock()
+		errs = append(errs, s.refresh(removed, flag)...)
+	}
+	s.setFile(o.fileKey(), fileMap)
+	if len(errs) > 0 {
+		return fileMap, fmt.Errorf("convert properties [errs:%v]", errs)
 	}
 	return fileMap, nil
 }
 
-func (s *Store) convertProperties(p *kvs.Properties, flag string) (map[string]string, []error) {
+// 按 charset 解码后解析 properties 文件, \uXXXX 转义在拆分 key/value 后还原
+func readProperties(fileName string, data []byte, charset string) (*kvs.Properties, error) {
+	data, unescape, err := decodeProperties(data, charset)
+	if err != nil {
+		return nil, fmt.Errorf("decode properties [fileName:%v] [err:%v]", fileName, err)
+	}
+	p := kvs.NewProperties()
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		key, value, ok := splitProperty(line)
+		if !ok {
+			continue
+		}
+		if unescape {
+			key, value = unescapeUnicode(key), unescapeUnicode(value)
+		}
+		p.Set(key, value)
+	}
+	return p, nil
+}
+
+// 与 kvs.Properties.Load 的拆分规则一致: 跳过空行和 # ! 开头的注释, 有 = 时按第一个 = 拆分, 否则按第一个 : 拆分
+// 本地副本的掩码也使用该规则, 保证掩码的 key 与解析出的 key 相同
+func splitProperty(line []byte) (string, string, bool) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' || line[0] == '!' {
+		return EMPTY_STRING, EMPTY_STRING, false
+	}
+	i := propertySeparator(line)
+	if i < 0 {
+		return EMPTY_STRING, EMPTY_STRING, false
+	}
+	return string(bytes.TrimSpace(line[:i])), string(bytes.TrimSpace(line[i+1:])), true
+}
+
+func propertySeparator(line []byte) int {
+	if i := bytes.IndexByte(line, '='); i >= 0 {
+		return i
+	}
+	return bytes.IndexByte(line, ':')
+}
+
+func (s *Store) setFile(fileName string, fileMap map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.files == nil {
+		s.files = make(map[string]map[string]string)
+	}
+	s.files[fileName] = fileMap
+}
+
+func (s *Store) getFile(fileName string) (map[string]string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	fileMap, ok := s.files[fileName]
+	return fileMap, ok
+}
+
+func (s *Store) convertProperties(p *kvs.Properties, flag string, o origin) (map[string]string, []error) {
 	keys := p.Keys()
 	var errs []error
 	fileMap := make(map[string]string)
@@ -85,34 +226,44 @@ func (s *Store) convertProperties(p *kvs.Properties, flag string) (map[string]st
 			errs = append(errs, err)
 			continue
 		}
-		if errs := s.reflectConf(value, key, flag); len(errs) > 0 {
-			errs = append(errs, errs...)
+		// 本地文件中已掩码的敏感值不生效, 保留默认值
+		if value == SECRET_MASK && s.isSecret(key) {
+			continue
+		}
+		if cErrs := s.reflectConf(value, key, flag, o); len(cErrs) > 0 {
+			errs = append(errs, cErrs...)
 		}
 	}
 	return fileMap, errs
 }
 
-func (s *Store) loadItem(key, value, flag string) error {
-	if errs := s.reflectConf(value, key, flag); len(errs) > 0 {
+func (s *Store) loadItem(key, value, flag, subscription string) error {
+	if errs := s.reflectConf(value, key, flag, origin{SOURCE_REMOTE_ITEM, EMPTY_STRING, subscription}); len(errs) > 0 {
 		return fmt.Errorf("set conf [err:%v]", errs)
 	}
 	return nil
 }
 
-func (s *Store) loadConf(confs []*Result, filePath string, ignore string) error {
+// files 为下载到的配置文件内容, 没有下载到的文件从 dir 中已有的本地文件加载
+func (s *Store) loadConf(confs []*Result, files map[string][]byte, dir, ignore string, subscription string) error {
 	for _, conf := range confs {
 		if ContainString(ignore, conf.Name) {
 			continue
 		}
 		if conf.Genre == DISCONF_TYPE_ITEM {
-			if errs := s.reflectConf(conf.Value, conf.Name, INIT_CONF); len(errs) > 0 {
+			if errs := s.reflectConf(conf.Value, conf.Name, INIT_CONF, origin{SOURCE_REMOTE_ITEM, EMPTY_STRING, subscription}); len(errs) > 0 {
 				return fmt.Errorf("set conf [err:%v]", errs)
 			}
 		}
 		if conf.Genre == DISCONF_TYPE_FILE {
 			if strings.HasSuffix(conf.Name, FILE_PROPERTIES) {
 				var err error
-				if _, err = s.loadProperties(filePath, conf.Name, INIT_CONF); err != nil {
+				if data, ok := files[conf.Name]; ok {
+					_, err = s.loadPropertiesData(conf.Name, data, INIT_CONF, origin{SOURCE_REMOTE_FILE, conf.Name, subscription})
+				} else {
+					_, err = s.loadProperties(dir, conf.Name, INIT_CONF, origin{SOURCE_LOCAL_FILE, conf.Name, subscription})
+				}
+				if err != nil {
 					return err
 				}
 			}
@@ -121,32 +272,161 @@ func (s *Store) loadConf(confs []*Result, filePath string, ignore string) error
 	return nil
 }
 
-func (s *Store) reflectConf(value string, tag string, flag string) []error {
-	elems := reflect.TypeOf(s.conf).Elem()
-	values := reflect.ValueOf(s.conf).Elem()
+func (s *Store) reflectConf(value string, tag string, flag string, o origin) []error {
+	s.mutex.Lock()
+	s.setRaw(tag, value, o)
+	keys := []string{tag}
+	var canaryErr error
+	if s.canaryKey != EMPTY_STRING && tag == s.canaryKey {
+		var changed []string
+		changed, canaryErr = s.setCanaryRules(value)
+		keys = append(keys, changed...)
+	}
+	s.mutex.Unlock()
+	errs := s.refresh(keys, flag)
+	if canaryErr != nil {
+		errs = append(errs, canaryErr)
+	}
+	return errs
+}
+
+// 重新设置 keys, 热加载时还重新设置引用了 keys 的 key
+func (s *Store) refresh(keys []string, flag string) []error {
 	var errs []error
-	for i := 0; i < elems.NumField(); i++ {
-		if elems.Field(i).Tag.Get(CONF_TAG) == tag {
-			switch flag {
-			case INIT_CONF:
-				if err := s.setConf(elems, values, i, value); err != nil {
-					errs = append(errs, err)
-				}
-			case AUTO_CONF:
-				if elems.Field(i).Tag.Get(AUTO_TAG) == AUTO_TRUE {
-					if err := s.setConf(elems, values, i, value); err != nil {
-						errs = append(errs, err)
-					}
-				}
-			default:
-				errs = append(errs, fmt.Errorf("unknown flag"))
+	for _, key := range keys {
+		// 初始加载时引用的 key 可能还没加载, 由 resolvePlaceholders 统一解析
+		errs = append(errs, s.resolveConf(key, flag, flag == INIT_CONF)...)
+		if flag == AUTO_CONF {
+			for _, dep := range s.dependents(key) {
+				errs = append(errs, s.resolveConf(dep, AUTO_CONF, false)...)
 			}
 		}
 	}
 	return errs
 }
 
+// 解析 key 的原始值中的占位符后设置到所有绑定的字段, deferred 为 true 时解析失败不设置也不报错
+func (s *Store) resolveConf(tag string, flag string, deferred bool) []error {
+	s.mutex.Lock()
+	var errs []error
+	for _, t := range s.targets {
+		errs = append(errs, s.resolveTarget(t, tag, flag, deferred)...)
+	}
+	s.mutex.Unlock()
+	s.notify()
+	return errs
+}
+
+// 调用方需持有 mutex
+func (s *Store) resolveTarget(t *target, tag string, flag string, deferred bool) []error {
+	fields := t.fields(tag)
+	if len(fields) == 0 {
+		return nil
+	}
+	raw, o, ok := s.targetValue(t, tag)
+	if !ok {
+		return nil
+	}
+	value, err := s.resolve(raw, []string{tag})
+	if err != nil && deferred {
+		return nil
+	}
+	elems := reflect.TypeOf(t.conf).Elem()
+	values := reflect.ValueOf(t.conf).Elem()
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+		fields = nil
+	}
+	for _, i := range fields {
+		switch flag {
+		case INIT_CONF:
+		case AUTO_CONF:
+			if elems.Field(i).Tag.Get(AUTO_TAG) != AUTO_TRUE && !isDynamicType(elems.Field(i).Type) {
+				continue
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unknown flag"))
+			continue
+		}
+		if err := s.applyConf(elems, values, i, value); err != nil {
+			errs = append(errs, err)
+		} else {
+			s.setOrigin(t.originKey(tag), o, isEncrypted(value) || elems.Field(i).Tag.Get(DECRYPT_TAG) != EMPTY_STRING)
+		}
+	}
+	if len(errs) > 0 && s.metrics != nil {
+		s.metrics.ObserveConversionError(tag)
+	}
+	return s.maskErrors(tag, value, s.maskErrors(tag, raw, errs))
+}
+
+// 解密后设置字段, 错误信息中不包含解密后的明文
+func (s *Store) applyConf(elems reflect.Type, values reflect.Value, i int, value string) error {
+	plaintext, err := s.decrypt(elems.Field(i), value)
+	if err != nil {
+		return err
+	}
+	if err := s.setConf(elems, values, i, plaintext); err != nil {
+		if plaintext != value && plaintext != EMPTY_STRING {
+			return errors.New(strings.Replace(err.Error(), plaintext, SECRET_MASK, -1))
+		}
+		return err
+	}
+	return nil
+}
+
+// 所有绑定结构体中的 key
+func (s *Store) keys() []string {
+	keys := []string{}
+	seen := make(map[string]bool)
+	for _, t := range s.targets {
+		for _, key := range t.keys() {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// 调用方需持有 mutex
+func (s *Store) setOrigin(key string, o origin, encrypted bool) {
+	if s.origins == nil {
+		s.origins = make(map[string]*keyOrigin)
+	}
+	// 被引用的 key 热加载后重新解析时来源不变, 保留 zk 版本
+	var version int32
+	if old, ok := s.origins[key]; ok && old.origin == o {
+		version = old.version
+	}
+	s.origins[key] = &keyOrigin{origin: o, updatedAt: time.Now(), version: version, encrypted: encrypted}
+}
+
+// 记录来自 name (配置项或配置文件) 的值对应的 zk 节点版本
+func (s *Store) setVersion(name string, disconfType int, version int32, subscription string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, o := range s.origins {
+		if o.subscription != subscription {
+			continue
+		}
+		if (disconfType == DISCONF_TYPE_ITEM && o.source == SOURCE_REMOTE_ITEM && key == name) ||
+			(disconfType == DISCONF_TYPE_FILE && o.source == SOURCE_REMOTE_FILE && o.file == name) {
+			o.version = version
+		}
+	}
+}
+
 func (s *Store) setConf(elems reflect.Type, values reflect.Value, i int, value string) error {
+	if d, ok := dynamicFieldOf(values.Field(i)); ok {
+		notify, err := d.set(value)
+		if notify != nil {
+			s.pending = append(s.pending, notify)
+		}
+		return err
+	}
 	switch elems.Field(i).Type.Name() {
 	case STRING_STR:
 		values.FieldByName(elems.Field(i).Name).SetString(value)
@@ -0,0 +1,107 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"fmt"
+)
+
+// 一组 app/version/env 的配置, 同一个客户端的所有订阅共用 zk 连接、http 请求和绑定的结构体
+type subscription struct {
+	app     string
+	version string
+	env     string
+	// 客户端自身的订阅为空, 其他订阅为 <app>_<version>_<env>
+	name   string
+	watch  IWatch
+	status *statusReporter
+}
+
+type subscriptionConf struct {
+	app     string
+	version string
+	env     string
+}
+
+// 为其他 app/version/env 创建共用 zk 连接的 IWatch, 默认的 Watch 实现了该接口
+type SubscriptionWatcher interface {
+	Subscribe(app, version, env string) IWatch
+}
+
+// 同时订阅其他 app/version/env 的配置, 如公共配置 common
+// 同一个 key 在多个订阅中存在时, 客户端自身的配置优先, 其次按 WithSubscription 的顺序
+// 配置文件下载到 downloadDir 下的 <app>_<version>_<env> 目录
+func WithSubscription(app, version, env string) ClientOption {
+	return func(c *Client) {
+		c.subscriptionConfs = append(c.subscriptionConfs, subscriptionConf{app: app, version: version, env: env})
+	}
+}
+
+func SubscriptionName(app, version, env string) string {
+	return fmt.Sprintf("%v_%v_%v", app, version, env)
+}
+
+func newSubscriptions(app, version, env string, watch IWatch, status *statusReporter, identity *Identity,
+	confs []subscriptionConf) ([]*subscription, error) {
+	subs := []*subscription{{app: app, version: version, env: env, watch: watch, status: status}}
+	if len(confs) == 0 {
+		return subs, nil
+	}
+	watcher, ok := watch.(SubscriptionWatcher)
+	if !ok {
+		return nil, fmt.Errorf("watcher does not support subscriptions [watcher:%T]", watch)
+	}
+	seen := map[string]bool{SubscriptionName(app, version, env): true}
+	for _, conf := range confs {
+		name := SubscriptionName(conf.app, conf.version, conf.env)
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate subscription [name:%v]", name)
+		}
+		seen[name] = true
+		subs = append(subs, &subscription{
+			app:     conf.app,
+			version: conf.version,
+			env:     conf.env,
+			name:    name,
+			watch:   watcher.Subscribe(conf.app, conf.version, conf.env),
+			status:  newStatusReporter(identity),
+		})
+	}
+	return subs, nil
+}
+
+func (s *subscription) suffixPrefixUrl() string {
+	return fmt.Sprintf(SUFFIX_PREFIX_URL, s.app, s.env, s.version)
+}
+
+// 其他订阅的配置文件所在目录
+func (s *subscription) downloadDir(base string) string {
+	if s.name == EMPTY_STRING {
+		return base
+	}
+	return base + s.name + "/"
+}
+
+// 指标、日志和缓存中的名称, 其他订阅的加上订阅名前缀以免重名
+func (s *subscription) qualify(name string) string {
+	return qualifyName(s.name, name)
+}
+
+func qualifyName(subscription, name string) string {
+	if subscription == EMPTY_STRING {
+		return name
+	}
+	return subscription + "/" + name
+}
+
+func subscriptionNames(subs []*subscription) []string {
+	names := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		names = append(names, sub.name)
+	}
+	return names
+}
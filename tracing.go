@@ -0,0 +1,69 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"context"
+	"net/http"
+)
+
+// 链路追踪接口, 通过 WithTracer 设置, 默认不追踪
+// OpenTelemetry 的实现见 disconfotel 包 (需要 -tags otel)
+type Tracer interface {
+	Start(ctx context.Context, name string, fields ...Field) (context.Context, Span)
+
+	// 把 ctx 中的 trace context 注入到发往 disconf 服务端的请求头
+	Inject(ctx context.Context, header http.Header)
+}
+
+type Span interface {
+	SetAttributes(fields ...Field)
+
+	RecordError(err error)
+
+	End()
+}
+
+const (
+	SPAN_INIT_CONF     = "disconf.initConf"
+	SPAN_RELOAD        = "disconf.reload"
+	SPAN_REGISTER      = "disconf.register"
+	SPAN_FETCH         = "disconf.fetch"
+	SPAN_ZK_CREATE     = "disconf.zk.create"
+	SPAN_ZK_SET        = "disconf.zk.set"
+	SPAN_ZK_VERSION    = "disconf.zk.version"
+	TRACE_FIELD_RESULT = "result"
+	RESULT_OK          = "ok"
+	RESULT_ERROR       = "error"
+)
+
+type noopTracer struct{}
+
+type noopSpan struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, fields ...Field) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) Inject(ctx context.Context, header http.Header) {}
+
+func (noopSpan) SetAttributes(fields ...Field) {}
+
+func (noopSpan) RecordError(err error) {}
+
+func (noopSpan) End() {}
+
+// 记录结果并结束 span
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetAttributes(F(TRACE_FIELD_RESULT, RESULT_ERROR))
+	} else {
+		span.SetAttributes(F(TRACE_FIELD_RESULT, RESULT_OK))
+	}
+	span.End()
+}
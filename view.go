@@ -0,0 +1,218 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 按 key 读取所有已加载的配置项和配置文件, 不需要绑定结构体, 热加载后立即可见
+// 值与绑定字段相同: 覆盖值优先, 解析占位符, 解密 ENC(...)
+type View struct {
+	store  *Store
+	logger Logger
+	prefix string
+}
+
+// 可以按 key 读取配置的类型, Client 和 View 都实现了该接口
+type Getter interface {
+	Get(key string) (string, bool)
+}
+
+// 占位符或解密失败时返回 false 并记录日志, 需要区分时使用 GetString
+func (v *View) Get(key string) (string, bool) {
+	value, ok, err := v.store.value(v.prefix + key)
+	if err != nil {
+		v.logger.Warn("get value", F(LOG_FIELD_KEY, v.prefix+key), F(LOG_FIELD_ERR, err))
+		return EMPTY_STRING, false
+	}
+	return value, ok
+}
+
+func (v *View) GetString(key string) (string, error) {
+	value, ok, err := v.store.value(v.prefix + key)
+	if err != nil {
+		return EMPTY_STRING, err
+	}
+	if !ok {
+		return EMPTY_STRING, fmt.Errorf("key not found [key:%v]", v.prefix+key)
+	}
+	return value, nil
+}
+
+func (v *View) GetInt(key string) (int64, error) {
+	return Get[int64](v, key)
+}
+
+func (v *View) GetBool(key string) (bool, error) {
+	return Get[bool](v, key)
+}
+
+func (v *View) GetDuration(key string) (time.Duration, error) {
+	return Get[time.Duration](v, key)
+}
+
+// 以 prefix 开头的 key, 相对于 View 的前缀, 按字典序排列
+func (v *View) Keys(prefix string) []string {
+	keys := []string{}
+	for _, key := range v.store.loadedKeys() {
+		if strings.HasPrefix(key, v.prefix+prefix) {
+			keys = append(keys, strings.TrimPrefix(key, v.prefix))
+		}
+	}
+	return keys
+}
+
+// 所有 key 当前的值
+func (v *View) All() map[string]string {
+	all := make(map[string]string)
+	for _, key := range v.Keys(EMPTY_STRING) {
+		if value, ok := v.Get(key); ok {
+			all[key] = value
+		}
+	}
+	return all
+}
+
+// 以 prefix 开头的 key 的视图, 如 Sub("mysql.").Get("username") 读取 mysql.username
+func (v *View) Sub(prefix string) *View {
+	return &View{store: v.store, logger: v.logger, prefix: v.prefix + prefix}
+}
+
+// 能区分 key 不存在和读取失败的 Getter, 如 View
+type stringGetter interface {
+	GetString(key string) (string, error)
+}
+
+// 按 T 转换 key 的值, 支持 string、bool、int、int64、int32、float64、float32、time.Duration
+// 和 []string (逗号分隔). g 实现了 GetString 时返回占位符或解密的错误
+func Get[T any](g Getter, key string) (T, error) {
+	var zero T
+	value, err := getString(g, key)
+	if err != nil {
+		return zero, err
+	}
+	v, err := convertValue(value, reflect.TypeOf(zero))
+	if err != nil {
+		return zero, fmt.Errorf("convert [key:%v] [type:%T] [err:%v]", key, zero, err)
+	}
+	return v.(T), nil
+}
+
+func getString(g Getter, key string) (string, error) {
+	if sg, ok := g.(stringGetter); ok {
+		return sg.GetString(key)
+	}
+	value, ok := g.Get(key)
+	if !ok {
+		return EMPTY_STRING, fmt.Errorf("key not found [key:%v]", key)
+	}
+	return value, nil
+}
+
+// typ 为 nil 时 (T 是 any 等接口类型) 返回错误
+func convertValue(value string, typ reflect.Type) (interface{}, error) {
+	if typ == nil {
+		return nil, fmt.Errorf(ERR_TYPE_VALUE)
+	}
+	if typ == reflect.TypeOf(time.Duration(0)) {
+		return time.ParseDuration(value)
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(value).Convert(typ).Interface(), nil
+	case reflect.Bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(v).Convert(typ).Interface(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(value, 10, typ.Bits())
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(v).Convert(typ).Interface(), nil
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(value, typ.Bits())
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(v).Convert(typ).Interface(), nil
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.String {
+			parts := []string{}
+			for _, part := range strings.Split(value, COMMA_STRING) {
+				if part = strings.TrimSpace(part); part != EMPTY_STRING {
+					parts = append(parts, part)
+				}
+			}
+			return reflect.ValueOf(parts).Convert(typ).Interface(), nil
+		}
+	}
+	return nil, fmt.Errorf(ERR_TYPE_VALUE)
+}
+
+// key 当前生效的值, 与 resolveConf 设置到字段的值相同
+func (s *Store) value(key string) (string, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	raw, _, ok := s.rawValue(key)
+	if !ok {
+		return EMPTY_STRING, false, nil
+	}
+	value, err := s.resolve(raw, []string{key})
+	if err != nil {
+		return EMPTY_STRING, true, err
+	}
+	value, err = s.decrypt(s.field(key), value)
+	if err != nil {
+		return EMPTY_STRING, true, err
+	}
+	return value, true, nil
+}
+
+// 绑定到 key 的第一个字段, 用于读取 decrypt 标签, 没有绑定时为空
+func (s *Store) field(key string) reflect.StructField {
+	for _, t := range s.targets {
+		if fields := t.fields(key); len(fields) > 0 {
+			return reflect.TypeOf(t.conf).Elem().Field(fields[0])
+		}
+	}
+	return reflect.StructField{}
+}
+
+// 已加载的 key、灰度的 key 和只有覆盖值的绑定 key, 按字典序排列
+func (s *Store) loadedKeys() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	seen := make(map[string]bool)
+	keys := []string{}
+	for key := range s.raws {
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	for key := range s.canary.values {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range s.keys() {
+		if _, _, ok := s.override(key); ok && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
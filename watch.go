@@ -7,11 +7,11 @@
 package disconf_client
 
 import (
+	"context"
 	"github.com/samuel/go-zookeeper/zk"
 	"fmt"
 	"time"
 	"strings"
-	"net"
 	"crypto/md5"
 	"encoding/hex"
 	"io"
@@ -19,20 +19,31 @@ import (
 	"crypto/rand"
 )
 
+// 监听配置变化并在 zookeeper 中注册实例, 可通过 WithWatcher 替换默认实现
 type IWatch interface {
-	initZk() error
+	InitZk() error
 
-	watchPath(key string, disconfType int, respChan chan watchResponse)
+	// 阻塞直到 key 对应的节点变化一次, 结果写入 respChan; 节点不存在时等待创建后再监听
+	WatchPath(key string, disconfType int, respChan chan WatchResponse)
 
-	createZkPath(path string, zkFlag int32, value []byte) error
+	CreateZkPath(path string, zkFlag int32, value []byte) error
 
-	getBaseUrl(key string, disconfType int) (string, error)
+	GetBaseUrl(key string, disconfType int) (string, error)
 
-	createZkDir(disconfType int, key string) error
+	CreateZkDir(disconfType int, key string) error
 
-	getLocalHostPath() (string, error)
+	GetLocalHostPath() (string, error)
 
-	setZkValue(path string, value []byte) error
+	SetZkValue(path string, value []byte) error
+
+	RegisterInstance(value []byte) error
+
+	UpdateInstance(value []byte) error
+
+	GetZkVersion(path string) (int32, error)
+
+	// zk 是否连接及会话 id
+	SessionState() (bool, int64)
 }
 
 type Watch struct {
@@ -42,6 +53,23 @@ type Watch struct {
 	version      string
 	env          string
 	debug        bool
+	identity     *Identity
+	zkConf       zkConfig
+	metrics      MetricsCollector
+	logger       Logger
+}
+
+type zkAuth struct {
+	scheme string
+	auth   []byte
+}
+
+// zookeeper 认证、chroot 和 ACL 配置
+type zkConfig struct {
+	auths        []zkAuth
+	chroot       string
+	acl          []zk.ACL
+	ephemeralAcl []zk.ACL
 }
 
 const (
@@ -49,30 +77,38 @@ const (
 	ZK_TIMEOUT       = 5
 	GO_TIMEOUT       = 3
 	PORT             = "8080"
+	INSTANCE_DIR     = "instance"
 )
 
-type watchResponse struct {
-	err         error
-	disconfType int
-	key         string
+// WatchPath 监听到节点变化(或出错)时发送, Version 为变化后 zk 节点的版本
+type WatchResponse struct {
+	Err         error
+	DisconfType int
+	Key         string
+	Version     int32
 }
 
-func newWatch(serverStr string, app, version, env string, debug bool) (*Watch, error) {
+func newWatch(serverStr string, app, version, env string, debug bool, identity *Identity, zkConf zkConfig, metrics MetricsCollector, logger Logger) (*Watch, error) {
 	servers := strings.Split(serverStr, COMMA_SPLIT)
 	watch := &Watch{
-		servers: servers,
-		app:     app,
-		version: version,
-		env:     env,
-		debug:   debug,
+		servers:  servers,
+		app:      app,
+		version:  version,
+		env:      env,
+		debug:    debug,
+		identity: identity,
+		zkConf:   zkConf,
+		metrics:  metrics,
+		logger:   logger,
 	}
-	if err := watch.initZk(); err != nil {
+	if err := watch.InitZk(); err != nil {
 		if debug {
 			return nil, err
 		}
 		ok := false
 		for i := 0; i < RE_CONNECT_TIMES; i++ {
-			if err = watch.initZk(); err == nil {
+			watch.logger.Warn("connect to zookeeper", F(LOG_FIELD_HOST, serverStr), F(LOG_FIELD_ATTEMPT, i+1), F(LOG_FIELD_ERR, err))
+			if err = watch.InitZk(); err == nil {
 				ok = true
 				break
 			}
@@ -84,9 +120,61 @@ func newWatch(serverStr string, app, version, env string, debug bool) (*Watch, e
 	return watch, nil
 }
 
-func (w *Watch) initZk() error {
+// 只读的 Watch, 用于命令行工具查看节点和监听变化, 不注册实例
+// 从 fetcher 获取 zk hosts, 支持 WithZkDigestAuth、WithZkAuth、WithZkChroot、WithMetrics 和 WithLogger
+func NewWatch(fetcher IFetcher, app, version, env string, opts ...ClientOption) (*Watch, error) {
+	c := newOptions(opts)
+	zkHosts, errs := fetcher.GetZkHost(context.Background())
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("get zk hosts [errs:%v]", errs)
+	}
+	return newWatch(zkHosts, app, version, env, false, nil, c.zkConf, c.metrics, c.logger)
+}
+
+func (w *Watch) Close() {
+	if w.zKClientConn != nil {
+		w.zKClientConn.Close()
+	}
+}
+
+// 各实例在 key 节点下上报的值, 按实例节点名 <host>_<port>_<id>
+func (w *Watch) KeyInstances(key string, disconfType int) (map[string][]byte, error) {
+	monitorPath, err := w.GetBaseUrl(key, disconfType)
+	if err != nil {
+		return nil, err
+	}
+	instances := make(map[string][]byte)
+	children, _, err := w.zKClientConn.Children(w.zkPath(monitorPath))
+	if err == zk.ErrNoNode {
+		return instances, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		value, _, err := w.zKClientConn.Get(w.zkPath(monitorPath + "/" + child))
+		if err == zk.ErrNoNode {
+			// 实例已下线
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		instances[child] = value
+	}
+	return instances, nil
+}
+
+// 其他 app/version/env 的 Watch, 共用同一个 zk 会话
+func (w *Watch) Subscribe(app, version, env string) IWatch {
+	sub := *w
+	sub.app, sub.version, sub.env = app, version, env
+	return &sub
+}
+
+func (w *Watch) InitZk() error {
 	if !w.isConnected() {
-		conn, connChan, err := zk.Connect(w.servers, time.Duration(ZK_TIMEOUT*time.Second))
+		conn, connChan, err := zk.Connect(w.servers, time.Duration(ZK_TIMEOUT*time.Second), zk.WithEventCallback(w.onEvent))
 		if err != nil {
 			return err
 		}
@@ -104,41 +192,128 @@ func (w *Watch) initZk() error {
 				break
 			}
 		}
+		// 会话内的断线重连由 zk 库重新提交认证信息, 新建连接时需要重新 AddAuth
+		for _, a := range w.zkConf.auths {
+			if err := conn.AddAuth(a.scheme, a.auth); err != nil {
+				conn.Close()
+				return fmt.Errorf("add zk auth [scheme:%v] [err:%v]", a.scheme, err)
+			}
+		}
 		w.zKClientConn = conn
+		// 只读的 Watch 不创建节点
+		if w.identity != nil {
+			if err := w.createChroot(); err != nil {
+				conn.Close()
+				w.zKClientConn = nil
+				return fmt.Errorf("create zk chroot [chroot:%v] [err:%v]", w.zkConf.chroot, err)
+			}
+		}
 	}
 	return nil
 }
 
+func (w *Watch) onEvent(e zk.Event) {
+	if e.Type != zk.EventSession || w.metrics == nil {
+		return
+	}
+	w.metrics.SetZkConnected(e.State == zk.StateConnected || e.State == zk.StateHasSession)
+}
+
 func (w *Watch) isConnected() bool {
-	if w.zKClientConn == nil || w.zKClientConn.State() != zk.StateConnected {
+	if w.zKClientConn == nil {
 		return false
 	}
-	return true
+	state := w.zKClientConn.State()
+	return state == zk.StateConnected || state == zk.StateHasSession
 }
 
-func (w *Watch) watchPath(key string, disconfType int, respChan chan watchResponse) {
-	monitorPath, err := w.getBaseUrl(key, disconfType)
-	if err != nil {
-		respChan <- watchResponse{err, disconfType, key}
-		return
+func (w *Watch) SessionState() (bool, int64) {
+	if !w.isConnected() {
+		return false, 0
+	}
+	return true, w.zKClientConn.SessionID()
+}
+
+// 加上 chroot 前缀, chroot 节点在 InitZk 中创建
+func (w *Watch) zkPath(path string) string {
+	if w.zkConf.chroot == EMPTY_STRING {
+		return path
+	}
+	return w.zkConf.chroot + path
+}
+
+func (w *Watch) getAcl(zkFlag int32) []zk.ACL {
+	if zkFlag&zk.FlagEphemeral != 0 && len(w.zkConf.ephemeralAcl) > 0 {
+		return w.zkConf.ephemeralAcl
 	}
-	_, _, keyEventCh, err := w.zKClientConn.GetW(monitorPath)
+	if len(w.zkConf.acl) > 0 {
+		return w.zkConf.acl
+	}
+	return zk.WorldACL(zk.PermAll)
+}
+
+func (w *Watch) createChroot() error {
+	if w.zkConf.chroot == EMPTY_STRING {
+		return nil
+	}
+	path := EMPTY_STRING
+	for _, node := range strings.Split(strings.Trim(w.zkConf.chroot, "/"), "/") {
+		path += "/" + node
+		isExist, _, err := w.zKClientConn.Exists(path)
+		if err != nil {
+			return err
+		}
+		if isExist {
+			continue
+		}
+		if _, err := w.zKClientConn.Create(path, nil, 0, w.getAcl(0)); err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Watch) WatchPath(key string, disconfType int, respChan chan WatchResponse) {
+	monitorPath, err := w.GetBaseUrl(key, disconfType)
 	if err != nil {
-		respChan <- watchResponse{err, disconfType, key}
+		respChan <- WatchResponse{err, disconfType, key, 0}
 		return
 	}
 	for {
-		select {
-		case e := <-keyEventCh:
-			if e.Type == zk.EventNodeDataChanged {
-				respChan <- watchResponse{e.Err, disconfType, key}
+		_, _, keyEventCh, err := w.zKClientConn.GetW(w.zkPath(monitorPath))
+		if err == zk.ErrNoNode {
+			// 节点还没有创建 (如还没有客户端加载过该 key) 时等待创建, 之后再监听数据变化
+			exists, _, existEventCh, err := w.zKClientConn.ExistsW(w.zkPath(monitorPath))
+			if err != nil {
+				respChan <- WatchResponse{err, disconfType, key, 0}
 				return
 			}
+			if !exists {
+				if e := <-existEventCh; e.Err != nil {
+					respChan <- WatchResponse{e.Err, disconfType, key, 0}
+					return
+				}
+			}
+			continue
+		}
+		if err != nil {
+			respChan <- WatchResponse{err, disconfType, key, 0}
+			return
+		}
+		// zk 的 watch 只触发一次, 节点删除等其他事件后重新监听
+		e := <-keyEventCh
+		if e.Type == zk.EventNodeDataChanged || e.Err != nil {
+			version, err := w.GetZkVersion(monitorPath)
+			if e.Err != nil {
+				err = e.Err
+			}
+			respChan <- WatchResponse{err, disconfType, key, version}
+			return
 		}
 	}
 }
 
-func (w *Watch) getBaseUrl(key string, disconfType int) (string, error) {
+func (w *Watch) GetBaseUrl(key string, disconfType int) (string, error) {
 	if !(disconfType == DISCONF_TYPE_FILE || disconfType == DISCONF_TYPE_ITEM) {
 		return EMPTY_STRING, fmt.Errorf("disconf type err")
 	}
@@ -148,19 +323,48 @@ func (w *Watch) getBaseUrl(key string, disconfType int) (string, error) {
 	return fmt.Sprintf("/disconf/%v_%v_%v/item/%v", w.app, w.version, w.env, key), nil
 }
 
-func (w *Watch) getLocalHostPath() (string, error) {
-	uuid, err := getGuid()
-	if err != nil {
-		return EMPTY_STRING, err
+func (w *Watch) GetLocalHostPath() (string, error) {
+	if w.identity == nil {
+		return EMPTY_STRING, fmt.Errorf("identity not set")
+	}
+	return w.identity.path(), nil
+}
+
+// 在 /disconf/<app>_<version>_<env>/instance 下注册实例身份、元数据和应用状态
+func (w *Watch) RegisterInstance(value []byte) error {
+	if w.identity == nil {
+		return fmt.Errorf("identity not set")
+	}
+	if err := w.CreateZkPath("/disconf", 0, nil); err != nil {
+		return err
+	}
+	if err := w.CreateZkPath(fmt.Sprintf("/disconf/%v_%v_%v", w.app, w.version, w.env), 0, nil); err != nil {
+		return err
+	}
+	instanceDir := fmt.Sprintf("/disconf/%v_%v_%v/%v", w.app, w.version, w.env, INSTANCE_DIR)
+	if err := w.CreateZkPath(instanceDir, 0, nil); err != nil {
+		return err
+	}
+	return w.CreateZkPath(instanceDir+w.identity.path(), zk.FlagEphemeral, value)
+}
+
+func (w *Watch) UpdateInstance(value []byte) error {
+	if w.identity == nil {
+		return fmt.Errorf("identity not set")
 	}
-	ip, err := getLocalIp()
+	return w.SetZkValue(fmt.Sprintf("/disconf/%v_%v_%v/%v%v", w.app, w.version, w.env, INSTANCE_DIR, w.identity.path()), value)
+}
+
+func (w *Watch) GetZkVersion(path string) (int32, error) {
+	_, stat, err := w.zKClientConn.Get(w.zkPath(path))
 	if err != nil {
-		return EMPTY_STRING, err
+		return 0, err
 	}
-	return fmt.Sprintf("/%v_%v_%v", ip, PORT, uuid), nil
+	return stat.Version, nil
 }
 
-func (w *Watch) createZkPath(path string, zkFlag int32, value []byte) error {
+func (w *Watch) CreateZkPath(path string, zkFlag int32, value []byte) error {
+	path = w.zkPath(path)
 	isExist, _, err := w.zKClientConn.Exists(path)
 	if err != nil {
 		return err
@@ -169,7 +373,7 @@ func (w *Watch) createZkPath(path string, zkFlag int32, value []byte) error {
 		isExist = false
 	}
 	if !isExist {
-		zkPath, err := w.zKClientConn.Create(path, value, zkFlag, zk.WorldACL(zk.PermAll))
+		zkPath, err := w.zKClientConn.Create(path, value, zkFlag, w.getAcl(zkFlag))
 		if err != nil {
 			return err
 		}
@@ -180,61 +384,51 @@ func (w *Watch) createZkPath(path string, zkFlag int32, value []byte) error {
 	return nil
 }
 
-func (w *Watch) setZkValue(path string, value []byte) error {
-	_, err := w.zKClientConn.Set(path, value,-1)
+func (w *Watch) SetZkValue(path string, value []byte) error {
+	_, err := w.zKClientConn.Set(w.zkPath(path), value, -1)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (w *Watch) createZkDir(disconfType int, key string) error {
-	ip, err := getLocalIp()
+func (w *Watch) CreateZkDir(disconfType int, key string) error {
+	ip, err := w.getLocalHost()
 	if err != nil {
 		return err
 	}
-	if err := w.createZkPath("/disconf", 0, nil); err != nil {
+	if err := w.CreateZkPath("/disconf", 0, nil); err != nil {
 		return err
 	}
-	if err := w.createZkPath(fmt.Sprintf("/disconf/%v_%v_%v", w.app, w.version, w.env), 0, nil); err != nil {
+	if err := w.CreateZkPath(fmt.Sprintf("/disconf/%v_%v_%v", w.app, w.version, w.env), 0, nil); err != nil {
 		return err
 	}
 	if !(disconfType == DISCONF_TYPE_FILE || disconfType == DISCONF_TYPE_ITEM) {
 		return fmt.Errorf("disconf type err")
 	}
 	if disconfType == DISCONF_TYPE_FILE {
-		if err := w.createZkPath(fmt.Sprintf("/disconf/%v_%v_%v/file", w.app, w.version, w.env), 0, []byte (ip)); err != nil {
+		if err := w.CreateZkPath(fmt.Sprintf("/disconf/%v_%v_%v/file", w.app, w.version, w.env), 0, []byte (ip)); err != nil {
 			return err
 		}
-		if err := w.createZkPath(fmt.Sprintf("/disconf/%v_%v_%v/file/%v", w.app, w.version, w.env, key), 0, []byte("")); err != nil {
+		if err := w.CreateZkPath(fmt.Sprintf("/disconf/%v_%v_%v/file/%v", w.app, w.version, w.env, key), 0, []byte("")); err != nil {
 			return err
 		}
 		return nil
 	}
-	if err := w.createZkPath(fmt.Sprintf("/disconf/%v_%v_%v/item", w.app, w.version, w.env), 0, []byte (ip)); err != nil {
+	if err := w.CreateZkPath(fmt.Sprintf("/disconf/%v_%v_%v/item", w.app, w.version, w.env), 0, []byte (ip)); err != nil {
 		return err
 	}
-	if err := w.createZkPath(fmt.Sprintf("/disconf/%v_%v_%v/item/%v", w.app, w.version, w.env, key), 0, []byte("")); err != nil {
+	if err := w.CreateZkPath(fmt.Sprintf("/disconf/%v_%v_%v/item/%v", w.app, w.version, w.env, key), 0, []byte("")); err != nil {
 		return err
 	}
 	return nil
 }
 
-func getLocalIp() (string, error) {
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		return EMPTY_STRING, err
-	}
-	var ip string
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				ip = ipnet.IP.String()
-				break
-			}
-		}
+func (w *Watch) getLocalHost() (string, error) {
+	if w.identity == nil {
+		return EMPTY_STRING, fmt.Errorf("identity not set")
 	}
-	return ip, err
+	return w.identity.Host, nil
 }
 
 func getMd5String(s string) string {
@@ -0,0 +1,300 @@
+/**
+ * @Author: llh
+ * @Date:   2018-01-25 16:08:29
+ * @Last Modified by:   llh
+ */
+
+package disconf_client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+func TestZkOptions(t *testing.T) {
+	c := newOptions([]ClientOption{WithZkDigestAuth("user", "secret"), WithZkAuth("ip", "10.0.0.1")})
+	want := []zkAuth{{scheme: ZK_SCHEME_DIGEST, auth: []byte("user:secret")}, {scheme: "ip", auth: []byte("10.0.0.1")}}
+	if !reflect.DeepEqual(c.zkConf.auths, want) {
+		t.Fatalf("unexpected auths [auths:%+v]", c.zkConf.auths)
+	}
+	for chroot, want := range map[string]string{"prod": "/prod", "/prod/": "/prod", "/a/b": "/a/b", "/": EMPTY_STRING, "": EMPTY_STRING} {
+		if c := newOptions([]ClientOption{WithZkChroot(chroot)}); c.zkConf.chroot != want {
+			t.Fatalf("unexpected chroot [chroot:%v] [got:%v] [want:%v]", chroot, c.zkConf.chroot, want)
+		}
+	}
+}
+
+func TestZkPath(t *testing.T) {
+	w := &Watch{}
+	if path := w.zkPath("/disconf/demo"); path != "/disconf/demo" {
+		t.Fatalf("unexpected path without chroot [path:%v]", path)
+	}
+	w.zkConf = newOptions([]ClientOption{WithZkChroot("prod")}).zkConf
+	if path := w.zkPath("/disconf/demo"); path != "/prod/disconf/demo" {
+		t.Fatalf("unexpected path with chroot [path:%v]", path)
+	}
+}
+
+func TestGetAcl(t *testing.T) {
+	w := &Watch{}
+	if acl := w.getAcl(zk.FlagEphemeral); !reflect.DeepEqual(acl, zk.WorldACL(zk.PermAll)) {
+		t.Fatalf("unexpected default acl [acl:%+v]", acl)
+	}
+	acl := zk.DigestACL(zk.PermAll, "user", "secret")
+	w.zkConf.acl = acl
+	if got := w.getAcl(0); !reflect.DeepEqual(got, acl) {
+		t.Fatalf("unexpected acl [acl:%+v]", got)
+	}
+	// 没有设置 WithZkEphemeralAcl 时临时节点与目录节点相同
+	if got := w.getAcl(zk.FlagEphemeral); !reflect.DeepEqual(got, acl) {
+		t.Fatalf("unexpected ephemeral acl [acl:%+v]", got)
+	}
+	ephemeralAcl := zk.WorldACL(zk.PermRead | zk.PermWrite | zk.PermDelete)
+	w.zkConf.ephemeralAcl = ephemeralAcl
+	if got := w.getAcl(zk.FlagEphemeral); !reflect.DeepEqual(got, ephemeralAcl) {
+		t.Fatalf("unexpected ephemeral acl [acl:%+v]", got)
+	}
+	if got := w.getAcl(zk.FlagEphemeral | zk.FlagSequence); !reflect.DeepEqual(got, ephemeralAcl) {
+		t.Fatalf("unexpected ephemeral sequential acl [acl:%+v]", got)
+	}
+	if got := w.getAcl(0); !reflect.DeepEqual(got, acl) {
+		t.Fatalf("unexpected persistent acl [acl:%+v]", got)
+	}
+}
+
+const (
+	ZK_OP_CREATE       = 1
+	ZK_OP_EXISTS       = 3
+	ZK_OP_GET_DATA     = 4
+	ZK_OP_SET_DATA     = 5
+	ZK_OP_PING         = 11
+	ZK_OP_CLOSE        = -11
+	ZK_ERR_NO_NODE     = -101
+	ZK_ERR_UNIMPL      = -6
+	ZK_XID_WATCHER     = -1
+	ZK_STATE_SYNC      = 3
+	ZK_EVENT_CREATED   = 1
+	ZK_EVENT_CHANGED   = 3
+	ZK_SESSION_TIMEOUT = 4000
+)
+
+// 只实现 exists、getData 和 watch 的 zookeeper 服务端, 用于测试 NewWatch 和 WatchPath
+type fakeZk struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	conn     net.Conn
+	nodes    map[string][]byte
+	versions map[string]int32
+	watches  map[string]bool
+	ops      []int32
+}
+
+func newFakeZk(t *testing.T) *fakeZk {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen [err:%v]", err)
+	}
+	z := &fakeZk{listener: listener, nodes: map[string][]byte{}, versions: map[string]int32{}, watches: map[string]bool{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go z.serve(conn)
+		}
+	}()
+	return z
+}
+
+func (z *fakeZk) Close() {
+	z.listener.Close()
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	if z.conn != nil {
+		z.conn.Close()
+	}
+}
+
+func readZkPacket(r io.Reader) ([]byte, error) {
+	var n int32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+func writeZk(buf *bytes.Buffer, values ...interface{}) {
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			binary.Write(buf, binary.BigEndian, int32(len(v)))
+			buf.WriteString(v)
+		case []byte:
+			binary.Write(buf, binary.BigEndian, int32(len(v)))
+			buf.Write(v)
+		default:
+			binary.Write(buf, binary.BigEndian, v)
+		}
+	}
+}
+
+// 调用方需持有 mutex
+func (z *fakeZk) send(xid int32, errCode int32, body []byte) {
+	buf := &bytes.Buffer{}
+	writeZk(buf, xid, int64(1), errCode)
+	buf.Write(body)
+	packet := &bytes.Buffer{}
+	writeZk(packet, buf.Bytes())
+	z.conn.Write(packet.Bytes())
+}
+
+func (z *fakeZk) stat(path string) []byte {
+	buf := &bytes.Buffer{}
+	writeZk(buf, int64(0), int64(0), int64(0), int64(0), z.versions[path], int32(0), int32(0), int64(0),
+		int32(len(z.nodes[path])), int32(0), int64(0))
+	return buf.Bytes()
+}
+
+func (z *fakeZk) serve(conn net.Conn) {
+	if _, err := readZkPacket(conn); err != nil {
+		return
+	}
+	z.mutex.Lock()
+	z.conn = conn
+	buf := &bytes.Buffer{}
+	writeZk(buf, int32(0), int32(ZK_SESSION_TIMEOUT), int64(1), make([]byte, 16))
+	packet := &bytes.Buffer{}
+	writeZk(packet, buf.Bytes())
+	conn.Write(packet.Bytes())
+	z.mutex.Unlock()
+	for {
+		req, err := readZkPacket(conn)
+		if err != nil {
+			return
+		}
+		xid, op := int32(binary.BigEndian.Uint32(req)), int32(binary.BigEndian.Uint32(req[4:]))
+		z.mutex.Lock()
+		z.ops = append(z.ops, op)
+		switch op {
+		case ZK_OP_PING, ZK_OP_CLOSE:
+			z.send(xid, 0, nil)
+		case ZK_OP_EXISTS, ZK_OP_GET_DATA:
+			n := binary.BigEndian.Uint32(req[8:])
+			path, watch := string(req[12:12+n]), req[12+n] == 1
+			data, ok := z.nodes[path]
+			switch {
+			case !ok && op == ZK_OP_GET_DATA:
+				z.send(xid, ZK_ERR_NO_NODE, nil)
+			case !ok:
+				z.watches[path] = z.watches[path] || watch
+				z.send(xid, ZK_ERR_NO_NODE, nil)
+			case op == ZK_OP_GET_DATA:
+				z.watches[path] = z.watches[path] || watch
+				body := &bytes.Buffer{}
+				writeZk(body, data)
+				z.send(xid, 0, append(body.Bytes(), z.stat(path)...))
+			default:
+				z.watches[path] = z.watches[path] || watch
+				z.send(xid, 0, z.stat(path))
+			}
+		default:
+			z.send(xid, ZK_ERR_UNIMPL, nil)
+		}
+		z.mutex.Unlock()
+	}
+}
+
+// 创建或更新节点, 触发节点上的 watch
+func (z *fakeZk) set(path string, data []byte) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	event := int32(ZK_EVENT_CHANGED)
+	if _, ok := z.nodes[path]; ok {
+		z.versions[path]++
+	} else {
+		event = ZK_EVENT_CREATED
+	}
+	z.nodes[path] = data
+	if z.watches[path] {
+		delete(z.watches, path)
+		body := &bytes.Buffer{}
+		writeZk(body, event, int32(ZK_STATE_SYNC), path)
+		z.send(ZK_XID_WATCHER, 0, body.Bytes())
+	}
+}
+
+func (z *fakeZk) waitWatch(t *testing.T, path string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		z.mutex.Lock()
+		ok := z.watches[path]
+		z.mutex.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wait watch timeout [path:%v]", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type zkHostFetcher struct {
+	IFetcher
+	host string
+}
+
+func (f zkHostFetcher) GetZkHost(ctx context.Context) (string, []error) {
+	return f.host, nil
+}
+
+func TestWatchMissingNode(t *testing.T) {
+	server := newFakeZk(t)
+	defer server.Close()
+	w, err := NewWatch(zkHostFetcher{host: server.listener.Addr().String()}, "demo", "1_0_0_0", "dev", WithZkChroot("prod"))
+	if err != nil {
+		t.Fatalf("new watch [err:%v]", err)
+	}
+	defer w.Close()
+	respChan := make(chan WatchResponse, 1)
+	go w.WatchPath("timeout", DISCONF_TYPE_ITEM, respChan)
+	path := "/prod/disconf/demo_1_0_0_0_dev/item/timeout"
+	server.waitWatch(t, path)
+	select {
+	case resp := <-respChan:
+		t.Fatalf("unexpected response for missing node [resp:%+v]", resp)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// 节点创建后继续监听数据变化, 创建本身不算变化
+	server.set(path, nil)
+	server.waitWatch(t, path)
+	server.set(path, []byte("3s"))
+	select {
+	case resp := <-respChan:
+		if resp.Err != nil || resp.Key != "timeout" || resp.Version != 1 {
+			t.Fatalf("unexpected response [resp:%+v]", resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait change timeout")
+	}
+	// 只读的 Watch 不创建 chroot, 也不注册实例
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, op := range server.ops {
+		if op == ZK_OP_CREATE || op == ZK_OP_SET_DATA {
+			t.Fatalf("read only watch wrote to zk [ops:%v]", server.ops)
+		}
+	}
+}